@@ -0,0 +1,169 @@
+package ack
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rosberry/go-wsserver"
+)
+
+type (
+	// Acker wraps application handlers and tracks acknowledgments of the
+	// messages sent with Send. Pass it as wsserver.Config.Handlers. Acked
+	// and given up messages free their slot of wsserver.Config.MaxInFlight.
+	// The optional handler interfaces of the application handlers are
+	// forwarded by wsserver.ForwardHandlers; acks arrive as text.
+	Acker struct {
+		wsserver.ForwardHandlers
+
+		cc      wsserver.ConnController
+		cfg     Config
+		mutex   sync.Mutex
+		pending map[string]*pending
+		seq     uint64
+	}
+
+	Config struct {
+		// OnAck is called when client id acknowledges messageID.
+		OnAck func(id uint, messageID string)
+
+		// OnTimeout is called when messageID is not acknowledged within the
+		// timeout given to Send. It may redeliver msg with Send.
+		OnTimeout func(id uint, messageID string, msg []byte)
+	}
+
+	// Message is the wire format of messages sent with Send.
+	Message struct {
+		ID      string          `json:"id"`
+		Payload json.RawMessage `json:"payload"`
+	}
+
+	// Ack is the frame a client sends to acknowledge a Message.
+	Ack struct {
+		Ack string `json:"ack"`
+	}
+
+	pending struct {
+		id    uint
+		timer *time.Timer
+	}
+)
+
+func New(h wsserver.Handlers, cfg Config) *Acker {
+	return &Acker{
+		ForwardHandlers: wsserver.ForwardHandlers{Handlers: h},
+		cfg:             cfg,
+		pending:         make(map[string]*pending),
+	}
+}
+
+// Send writes payload, which must be valid JSON, to id tagged with a new
+// message id and waits up to timeout for its acknowledgment.
+func (a *Acker) Send(id uint, payload []byte, timeout time.Duration) (messageID string, err error) {
+	messageID = strconv.FormatUint(atomic.AddUint64(&a.seq, 1), 10)
+	msg, err := json.Marshal(Message{ID: messageID, Payload: payload})
+	if err != nil {
+		return "", err
+	}
+
+	p := &pending{id: id}
+	a.mutex.Lock()
+	a.pending[messageID] = p
+	p.timer = time.AfterFunc(timeout, func() {
+		if !a.take(messageID, id) {
+			return
+		}
+		// The message is given up, free its slot for a redelivery.
+		a.release(id)
+		if a.cfg.OnTimeout != nil {
+			a.cfg.OnTimeout(id, messageID, payload)
+		}
+	})
+	a.mutex.Unlock()
+
+	if err := a.write(id, msg); err != nil {
+		if a.take(messageID, id) {
+			p.timer.Stop()
+		}
+		return "", err
+	}
+	return messageID, nil
+}
+
+// take removes the pending message of id and reports whether it was found.
+func (a *Acker) take(messageID string, id uint) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	p, ok := a.pending[messageID]
+	if !ok || p.id != id {
+		return false
+	}
+	delete(a.pending, messageID)
+	return true
+}
+
+// write writes msg to id in a slot of wsserver.Config.MaxInFlight if the
+// controller has a window.
+func (a *Acker) write(id uint, msg []byte) error {
+	if ac, ok := a.cc.(wsserver.AckController); ok {
+		return ac.WriteAcked(id, msg)
+	}
+	return a.cc.WriteMessage(id, msg)
+}
+
+// release frees the slot of an acked or given up message to id if the
+// controller has a MaxInFlight window.
+func (a *Acker) release(id uint) {
+	if ac, ok := a.cc.(wsserver.AckController); ok {
+		ac.Ack(id, 1)
+	}
+}
+
+func (a *Acker) SetConnCtrlr(ctrlr wsserver.ConnController) {
+	a.cc = ctrlr
+	a.Handlers.SetConnCtrlr(ctrlr)
+}
+
+// OnText handles acknowledgments of pending messages and passes any other
+// message to the application handlers.
+func (a *Acker) OnText(id uint, msg []byte) {
+	if !a.ack(id, msg) {
+		a.Handlers.OnText(id, msg)
+	}
+}
+
+// OnTextContext is OnText for application handlers implementing
+// wsserver.ContextTextHandlers.
+func (a *Acker) OnTextContext(ctx context.Context, id uint, msg []byte) {
+	if a.ack(id, msg) {
+		return
+	}
+	a.ForwardHandlers.OnTextContext(ctx, id, msg)
+}
+
+// ack handles msg if it acknowledges a pending message of id.
+func (a *Acker) ack(id uint, msg []byte) bool {
+	var ack Ack
+	if json.Unmarshal(msg, &ack) != nil || ack.Ack == "" {
+		return false
+	}
+	a.mutex.Lock()
+	p, ok := a.pending[ack.Ack]
+	if ok && p.id == id {
+		delete(a.pending, ack.Ack)
+		p.timer.Stop()
+	}
+	a.mutex.Unlock()
+	if !ok || p.id != id {
+		return false
+	}
+	a.release(id)
+	if a.cfg.OnAck != nil {
+		a.cfg.OnAck(id, ack.Ack)
+	}
+	return true
+}
@@ -0,0 +1,238 @@
+package ack
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	wsserver "github.com/rosberry/go-wsserver"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// appHandlers authenticate every token as id 1 and record the texts the
+// Acker passes through.
+type appHandlers struct {
+	wsserver.NoopHandlers
+	texts chan string
+}
+
+func (h appHandlers) OnAuth(token string) (id uint, ok bool) {
+	return 1, true
+}
+
+func (h appHandlers) OnText(id uint, msg []byte) {
+	h.texts <- string(msg)
+}
+
+// optionalHandlers implement some optional handler interfaces the Acker
+// forwards.
+type optionalHandlers struct {
+	appHandlers
+	reasons chan wsserver.OfflineReason
+}
+
+func (h optionalHandlers) OnTextContext(ctx context.Context, id uint, msg []byte) {
+	h.texts <- "ctx:" + string(msg)
+}
+
+func (h optionalHandlers) OnOfflineReason(id uint, reason wsserver.OfflineReason) {
+	h.reasons <- reason
+}
+
+var errExpired = errors.New("Token expired")
+
+func (h optionalHandlers) OnAuthErr(token string) (id uint, err error) {
+	return 0, errExpired
+}
+
+// pipeDial connects a client to srv through net.Pipe.
+func pipeDial(srv *wsserver.WS) (*websocket.Conn, error) {
+	server, client := net.Pipe()
+	go srv.HandleConn(server)
+	d := websocket.Dialer{
+		NetDial: func(network, addr string) (net.Conn, error) {
+			return client, nil
+		},
+	}
+	c, _, err := d.Dial("ws://pipe/?token=1", nil)
+	return c, err
+}
+
+// readMessages passes the Messages read from c to msgs until it fails.
+// net.Pipe is unbuffered, so writes to c block until they are read.
+func readMessages(c *websocket.Conn, msgs chan Message) {
+	for {
+		var msg Message
+		_, p, err := c.ReadMessage()
+		if err != nil || json.Unmarshal(p, &msg) != nil {
+			return
+		}
+		msgs <- msg
+	}
+}
+
+func TestAckWindow(t *testing.T) {
+	Convey("Given an Acker on WS server with one message in flight", t, func() {
+		acks := make(chan string, 1)
+		timeouts := make(chan string, 1)
+		a := New(appHandlers{texts: make(chan string, 1)}, Config{
+			OnAck: func(id uint, messageID string) {
+				acks <- messageID
+			},
+			OnTimeout: func(id uint, messageID string, msg []byte) {
+				timeouts <- messageID
+			},
+		})
+		srv, err := wsserver.New(&wsserver.Config{
+			Handlers:    a,
+			MaxInFlight: 1,
+		})
+		So(err, ShouldBeNil)
+		c, err := pipeDial(srv)
+		So(err, ShouldBeNil)
+		msgs := make(chan Message, 10)
+		go readMessages(c, msgs)
+		time.Sleep(time.Millisecond * 100)
+		Convey("When a message is unacknowledged", func() {
+			id, err := a.Send(1, []byte(`{"n":1}`), time.Second)
+			So(err, ShouldBeNil)
+			So((<-msgs).ID, ShouldEqual, id)
+			Convey("Then the next one should not fit the window", func() {
+				_, err := a.Send(1, []byte(`{"n":2}`), time.Second)
+				So(err, ShouldEqual, wsserver.ErrWindowFull)
+			})
+			Convey("Then the client's ack should free its slot", func() {
+				So(c.WriteJSON(Ack{Ack: id}), ShouldBeNil)
+				So(<-acks, ShouldEqual, id)
+				_, err := a.Send(1, []byte(`{"n":2}`), time.Second)
+				So(err, ShouldBeNil)
+			})
+		})
+		Convey("When a message is given up", func() {
+			id, err := a.Send(1, []byte(`{"n":1}`), 50*time.Millisecond)
+			So(err, ShouldBeNil)
+			So(<-timeouts, ShouldEqual, id)
+			Convey("Then it should be redelivered in its slot", func() {
+				_, err := a.Send(1, []byte(`{"n":1}`), time.Second)
+				So(err, ShouldBeNil)
+			})
+		})
+		Reset(func() {
+			c.Close()
+		})
+	})
+}
+
+// sentMessage waits for the nth message written to cc.
+func sentMessage(cc *wsserver.RecordingConnController, n int) (msg Message) {
+	for len(cc.Messages()) < n {
+		time.Sleep(time.Millisecond)
+	}
+	json.Unmarshal(cc.Messages()[n-1].Msg, &msg)
+	return msg
+}
+
+func TestAcker(t *testing.T) {
+	Convey("Given an Acker redelivering unacknowledged messages once", t, func() {
+		h := appHandlers{texts: make(chan string, 1)}
+		acks := make(chan string, 1)
+		givenUp := make(chan string, 1)
+		var a *Acker
+		a = New(h, Config{
+			OnAck: func(id uint, messageID string) {
+				acks <- messageID
+			},
+			OnTimeout: func(id uint, messageID string, msg []byte) {
+				if messageID == "1" {
+					a.Send(id, msg, 50*time.Millisecond)
+				} else {
+					givenUp <- messageID
+				}
+			},
+		})
+		cc := &wsserver.RecordingConnController{}
+		a.SetConnCtrlr(cc)
+		id, err := a.Send(1, []byte(`{"n":1}`), 50*time.Millisecond)
+		So(err, ShouldBeNil)
+		msg := sentMessage(cc, 1)
+		Convey("The message should be sent with its id", func() {
+			So(msg.ID, ShouldEqual, id)
+			So(string(msg.Payload), ShouldEqual, `{"n":1}`)
+		})
+		Convey("When the client acknowledges it", func() {
+			a.OnText(1, []byte(`{"ack":"`+id+`"}`))
+			Convey("Then 'OnAck' should be called instead of 'OnText'", func() {
+				So(<-acks, ShouldEqual, id)
+				So(len(h.texts), ShouldEqual, 0)
+			})
+			Convey("Then it should not be redelivered", func() {
+				time.Sleep(100 * time.Millisecond)
+				So(cc.Messages(), ShouldHaveLength, 1)
+			})
+		})
+		Convey("When another client acknowledges it", func() {
+			other := `{"ack":"` + id + `"}`
+			a.OnText(2, []byte(other))
+			Convey("Then the ack should pass through to the handlers", func() {
+				So(<-h.texts, ShouldEqual, other)
+				So(len(acks), ShouldEqual, 0)
+			})
+		})
+		Convey("When the client never acknowledges it", func() {
+			retry := sentMessage(cc, 2)
+			Convey("Then it should be redelivered with a new id", func() {
+				So(retry.ID, ShouldNotEqual, id)
+				So(string(retry.Payload), ShouldEqual, `{"n":1}`)
+			})
+			Convey("Then the redelivery should be given up", func() {
+				So(<-givenUp, ShouldEqual, retry.ID)
+				So(cc.Messages(), ShouldHaveLength, 2)
+				Convey("And a late ack should pass through to the handlers", func() {
+					late := `{"ack":"` + retry.ID + `"}`
+					a.OnText(1, []byte(late))
+					So(<-h.texts, ShouldEqual, late)
+				})
+			})
+		})
+	})
+}
+
+func TestAckerOptionalHandlers(t *testing.T) {
+	Convey("Given an Acker on handlers implementing optional interfaces", t, func() {
+		h := optionalHandlers{
+			appHandlers: appHandlers{texts: make(chan string, 1)},
+			reasons:     make(chan wsserver.OfflineReason, 1),
+		}
+		a := New(h, Config{})
+		a.SetConnCtrlr(&wsserver.RecordingConnController{})
+		Convey("'OnTextContext' should be forwarded", func() {
+			a.OnTextContext(context.Background(), 1, []byte("hi"))
+			So(<-h.texts, ShouldEqual, "ctx:hi")
+		})
+		Convey("'OnOfflineReason' should be forwarded", func() {
+			a.OnOfflineReason(1, wsserver.OfflineReason{Err: wsserver.ErrIdleTimeout})
+			So((<-h.reasons).Err, ShouldEqual, wsserver.ErrIdleTimeout)
+		})
+		Convey("'OnAuthErr' should be used to authenticate", func() {
+			_, err := a.OnAuthRequest(wsserver.Request{}, "token")
+			So(err, ShouldEqual, errExpired)
+		})
+	})
+	Convey("Given an Acker on handlers implementing none", t, func() {
+		h := appHandlers{texts: make(chan string, 1)}
+		a := New(h, Config{})
+		Convey("'OnTextContext' should fall back to 'OnText'", func() {
+			a.OnTextContext(context.Background(), 1, []byte("hi"))
+			So(<-h.texts, ShouldEqual, "hi")
+		})
+		Convey("'OnAuth' should be used to authenticate", func() {
+			id, err := a.OnAuthRequest(wsserver.Request{}, "token")
+			So(err, ShouldBeNil)
+			So(id, ShouldEqual, 1)
+		})
+	})
+}
@@ -0,0 +1,31 @@
+package wsserver
+
+import "sync/atomic"
+
+// EchoHandlers authenticate any token as a new id and write every text
+// message back to its sender. They serve smoke tests and as example
+// Handlers.
+type EchoHandlers struct {
+	cc     ConnController
+	lastID uint64 // accessed atomically
+}
+
+func (h *EchoHandlers) SetConnCtrlr(ctrlr ConnController) {
+	h.cc = ctrlr
+}
+
+func (h *EchoHandlers) OnAuth(token string) (id uint, ok bool) {
+	return uint(atomic.AddUint64(&h.lastID, 1)), true
+}
+
+func (h *EchoHandlers) OnOnline(id uint) {}
+
+func (h *EchoHandlers) OnText(id uint, msg []byte) {
+	h.cc.WriteMessage(id, msg)
+}
+
+func (h *EchoHandlers) OnSend(id uint, msg []byte) (ok bool) {
+	return true
+}
+
+func (h *EchoHandlers) OnOffline(id uint) {}
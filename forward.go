@@ -0,0 +1,66 @@
+package wsserver
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// ForwardHandlers implement the optional handler interfaces, except
+// ValueHandlers, by calling the embedded Handlers the way the server would:
+// each method uses the interface of Handlers if implemented and falls back
+// to the server's behavior otherwise. Embed them in handlers wrapping
+// application handlers, e.g. a message router, to keep the optional
+// interfaces of the wrapped ones working.
+type ForwardHandlers struct {
+	Handlers
+}
+
+func (f ForwardHandlers) OnTextContext(ctx context.Context, id uint, msg []byte) {
+	if h, ok := f.Handlers.(ContextTextHandlers); ok {
+		h.OnTextContext(ctx, id, msg)
+	} else {
+		f.Handlers.OnText(id, msg)
+	}
+}
+
+func (f ForwardHandlers) OnAuthRequest(req Request, token string) (id uint, err error) {
+	if h, ok := f.Handlers.(RequestAuthHandlers); ok {
+		return h.OnAuthRequest(req, token)
+	}
+	if h, ok := f.Handlers.(AuthErrHandlers); ok {
+		return h.OnAuthErr(token)
+	}
+	if id, ok := f.Handlers.OnAuth(token); ok {
+		return id, nil
+	}
+	return 0, ErrAuthFailed
+}
+
+func (f ForwardHandlers) OnOfflineReason(id uint, reason OfflineReason) {
+	if h, ok := f.Handlers.(OfflineReasonHandlers); ok {
+		h.OnOfflineReason(id, reason)
+	} else {
+		f.Handlers.OnOffline(id)
+	}
+}
+
+func (f ForwardHandlers) OnReconnect(id uint) {
+	if h, ok := f.Handlers.(ReconnectHandlers); ok {
+		h.OnReconnect(id)
+	}
+}
+
+func (f ForwardHandlers) PingInterval(id uint) time.Duration {
+	if h, ok := f.Handlers.(PingIntervalHandlers); ok {
+		return h.PingInterval(id)
+	}
+	return 0
+}
+
+func (f ForwardHandlers) ResponseHeader(id uint, req Request) http.Header {
+	if h, ok := f.Handlers.(ResponseHeaderHandlers); ok {
+		return h.ResponseHeader(id, req)
+	}
+	return nil
+}
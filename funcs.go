@@ -0,0 +1,52 @@
+package wsserver
+
+// funcHandlers back the Config function shortcuts. Unset functions do
+// nothing and OnSend lets every message through.
+type funcHandlers struct {
+	auth    func(token string) (id uint, ok bool)
+	online  func(id uint)
+	text    func(id uint, msg []byte)
+	send    func(id uint, msg []byte) (ok bool)
+	offline func(id uint)
+}
+
+func newFuncHandlers(cfg *Config) *funcHandlers {
+	return &funcHandlers{
+		auth:    cfg.AuthFunc,
+		online:  cfg.OnlineFunc,
+		text:    cfg.TextFunc,
+		send:    cfg.SendFunc,
+		offline: cfg.OfflineFunc,
+	}
+}
+
+func (h *funcHandlers) SetConnCtrlr(ctrlr ConnController) {}
+
+func (h *funcHandlers) OnAuth(token string) (id uint, ok bool) {
+	return h.auth(token)
+}
+
+func (h *funcHandlers) OnOnline(id uint) {
+	if h.online != nil {
+		h.online(id)
+	}
+}
+
+func (h *funcHandlers) OnText(id uint, msg []byte) {
+	if h.text != nil {
+		h.text(id, msg)
+	}
+}
+
+func (h *funcHandlers) OnSend(id uint, msg []byte) (ok bool) {
+	if h.send != nil {
+		return h.send(id, msg)
+	}
+	return true
+}
+
+func (h *funcHandlers) OnOffline(id uint) {
+	if h.offline != nil {
+		h.offline(id)
+	}
+}
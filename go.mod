@@ -3,11 +3,10 @@ module github.com/rosberry/go-wsserver
 go 1.14
 
 require (
-	github.com/gobwas/httphead v0.1.0 // indirect
+	github.com/gobwas/httphead v0.1.0
 	github.com/gobwas/pool v0.2.1 // indirect
 	github.com/gobwas/ws v1.0.4
 	github.com/gorilla/websocket v1.4.2
-	github.com/rosberry/go-wsserver v0.0.0-20210201114821-23623753a4aa
 	github.com/smartystreets/goconvey v1.6.4
 	golang.org/x/sys v0.0.0-20210426230700-d19ff857e887 // indirect
 )
@@ -0,0 +1,25 @@
+package wsserver
+
+// NoopHandlers implement Handlers doing nothing: OnAuth rejects every
+// token and OnSend lets every message through. Embed them and override
+// only the methods needed, at least OnAuth, so a type keeps satisfying
+// Handlers when methods are added to it. The optional interfaces, e.g.
+// OfflineReasonHandlers, aren't implemented, as implementing them changes
+// the server's behavior.
+type NoopHandlers struct{}
+
+func (NoopHandlers) SetConnCtrlr(ctrlr ConnController) {}
+
+func (NoopHandlers) OnAuth(token string) (id uint, ok bool) {
+	return 0, false
+}
+
+func (NoopHandlers) OnOnline(id uint) {}
+
+func (NoopHandlers) OnText(id uint, msg []byte) {}
+
+func (NoopHandlers) OnSend(id uint, msg []byte) (ok bool) {
+	return true
+}
+
+func (NoopHandlers) OnOffline(id uint) {}
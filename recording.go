@@ -0,0 +1,55 @@
+package wsserver
+
+import "sync"
+
+// RecordingConnController is a ConnController that records its calls in
+// memory instead of writing to connections. Pass it to SetConnCtrlr to
+// unit test Handlers without a server. It is safe for concurrent use.
+type RecordingConnController struct {
+	mutex    sync.Mutex
+	messages []RecordedMessage
+	closed   []uint
+}
+
+// RecordedMessage is a WriteMessage call recorded by
+// RecordingConnController.
+type RecordedMessage struct {
+	ID  uint
+	Msg []byte
+}
+
+func (r *RecordingConnController) WriteMessage(id uint, msg []byte) error {
+	r.mutex.Lock()
+	r.messages = append(r.messages, RecordedMessage{ID: id, Msg: append([]byte(nil), msg...)})
+	r.mutex.Unlock()
+	return nil
+}
+
+func (r *RecordingConnController) CloseConnection(id uint) error {
+	r.mutex.Lock()
+	r.closed = append(r.closed, id)
+	r.mutex.Unlock()
+	return nil
+}
+
+// Messages returns the recorded WriteMessage calls in order.
+func (r *RecordingConnController) Messages() []RecordedMessage {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]RecordedMessage(nil), r.messages...)
+}
+
+// Closed returns the ids passed to CloseConnection in order.
+func (r *RecordingConnController) Closed() []uint {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]uint(nil), r.closed...)
+}
+
+// Reset forgets the recorded calls.
+func (r *RecordingConnController) Reset() {
+	r.mutex.Lock()
+	r.messages = nil
+	r.closed = nil
+	r.mutex.Unlock()
+}
@@ -0,0 +1,123 @@
+package request
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rosberry/go-wsserver"
+)
+
+type (
+	// Requester wraps application handlers and adds Request on top of the
+	// connection controller. Pass it as wsserver.Config.Handlers. The
+	// optional handler interfaces of the application handlers are
+	// forwarded by wsserver.ForwardHandlers; replies arrive as text.
+	Requester struct {
+		wsserver.ForwardHandlers
+
+		cc      wsserver.ConnController
+		mutex   sync.Mutex
+		pending map[string]pending
+		seq     uint64
+	}
+
+	// Envelope is the wire format of requests and replies. A client replies
+	// to a request by sending an envelope with the same ID.
+	Envelope struct {
+		ID      string          `json:"id"`
+		Payload json.RawMessage `json:"payload"`
+	}
+
+	pending struct {
+		id    uint
+		reply chan []byte
+	}
+)
+
+var ErrTimeout = errors.New("Request timeout")
+
+func New(h wsserver.Handlers) *Requester {
+	return &Requester{
+		ForwardHandlers: wsserver.ForwardHandlers{Handlers: h},
+		pending:         make(map[string]pending),
+	}
+}
+
+// Request sends payload, which must be valid JSON, to id and waits for the
+// reply carrying the same correlation id.
+func (r *Requester) Request(id uint, payload []byte, timeout time.Duration) ([]byte, error) {
+	cid := strconv.FormatUint(atomic.AddUint64(&r.seq, 1), 10)
+	msg, err := json.Marshal(Envelope{ID: cid, Payload: payload})
+	if err != nil {
+		return nil, err
+	}
+
+	p := pending{id: id, reply: make(chan []byte, 1)}
+	r.mutex.Lock()
+	r.pending[cid] = p
+	r.mutex.Unlock()
+	defer func() {
+		r.mutex.Lock()
+		delete(r.pending, cid)
+		r.mutex.Unlock()
+	}()
+
+	if err := r.cc.WriteMessage(id, msg); err != nil {
+		return nil, err
+	}
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case reply := <-p.reply:
+		return reply, nil
+	case <-t.C:
+		return nil, ErrTimeout
+	}
+}
+
+func (r *Requester) SetConnCtrlr(ctrlr wsserver.ConnController) {
+	r.cc = ctrlr
+	r.Handlers.SetConnCtrlr(ctrlr)
+}
+
+// OnText resolves pending requests with their replies and passes any other
+// message to the application handlers.
+func (r *Requester) OnText(id uint, msg []byte) {
+	if !r.resolve(id, msg) {
+		r.Handlers.OnText(id, msg)
+	}
+}
+
+// OnTextContext is OnText for application handlers implementing
+// wsserver.ContextTextHandlers.
+func (r *Requester) OnTextContext(ctx context.Context, id uint, msg []byte) {
+	if r.resolve(id, msg) {
+		return
+	}
+	r.ForwardHandlers.OnTextContext(ctx, id, msg)
+}
+
+// resolve handles msg if it replies to a pending request to id.
+func (r *Requester) resolve(id uint, msg []byte) bool {
+	var e Envelope
+	if json.Unmarshal(msg, &e) != nil || e.ID == "" {
+		return false
+	}
+	r.mutex.Lock()
+	p, ok := r.pending[e.ID]
+	if ok && p.id == id {
+		delete(r.pending, e.ID)
+	}
+	r.mutex.Unlock()
+	if !ok || p.id != id {
+		return false
+	}
+	p.reply <- e.Payload
+	return true
+}
@@ -0,0 +1,127 @@
+package request
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	wsserver "github.com/rosberry/go-wsserver"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// appHandlers record the texts the Requester passes through.
+type appHandlers struct {
+	wsserver.NoopHandlers
+	texts chan string
+}
+
+func (h appHandlers) OnText(id uint, msg []byte) {
+	h.texts <- string(msg)
+}
+
+// optionalHandlers implement some optional handler interfaces the
+// Requester forwards.
+type optionalHandlers struct {
+	appHandlers
+	reasons chan wsserver.OfflineReason
+}
+
+func (h optionalHandlers) OnTextContext(ctx context.Context, id uint, msg []byte) {
+	h.texts <- "ctx:" + string(msg)
+}
+
+func (h optionalHandlers) OnOfflineReason(id uint, reason wsserver.OfflineReason) {
+	h.reasons <- reason
+}
+
+// sentEnvelope waits for the Requester to write its next request to cc.
+func sentEnvelope(cc *wsserver.RecordingConnController, n int) (e Envelope) {
+	for len(cc.Messages()) < n {
+		time.Sleep(time.Millisecond)
+	}
+	json.Unmarshal(cc.Messages()[n-1].Msg, &e)
+	return e
+}
+
+func TestRequest(t *testing.T) {
+	Convey("Given a Requester on a recording controller", t, func() {
+		h := appHandlers{texts: make(chan string, 1)}
+		r := New(h)
+		cc := &wsserver.RecordingConnController{}
+		r.SetConnCtrlr(cc)
+		type result struct {
+			reply []byte
+			err   error
+		}
+		results := make(chan result, 1)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			reply, err := r.Request(1, []byte(`{"q":1}`), 200*time.Millisecond)
+			results <- result{reply, err}
+		}()
+		e := sentEnvelope(cc, 1)
+		Convey("The request should be sent to id in an envelope", func() {
+			So(cc.Messages()[0].ID, ShouldEqual, 1)
+			So(e.ID, ShouldNotBeEmpty)
+			So(string(e.Payload), ShouldEqual, `{"q":1}`)
+		})
+		Convey("When the client replies with the same id", func() {
+			r.OnText(1, []byte(`{"id":"`+e.ID+`","payload":{"a":2}}`))
+			Convey("Then Request should return the reply payload", func() {
+				res := <-results
+				So(res.err, ShouldBeNil)
+				So(string(res.reply), ShouldEqual, `{"a":2}`)
+				So(len(h.texts), ShouldEqual, 0)
+			})
+		})
+		Convey("When no reply arrives in time", func() {
+			res := <-results
+			Convey("Then Request should fail with ErrTimeout", func() {
+				So(res.err, ShouldEqual, ErrTimeout)
+			})
+			Convey("Then a late reply should pass through to the handlers", func() {
+				late := `{"id":"` + e.ID + `","payload":{}}`
+				r.OnText(1, []byte(late))
+				So(<-h.texts, ShouldEqual, late)
+			})
+		})
+		Convey("When another client replies with the same id", func() {
+			other := `{"id":"` + e.ID + `","payload":{}}`
+			r.OnText(2, []byte(other))
+			Convey("Then it should pass through to the handlers", func() {
+				So(<-h.texts, ShouldEqual, other)
+				So((<-results).err, ShouldEqual, ErrTimeout)
+			})
+		})
+		Convey("When the client sends any other message", func() {
+			r.OnText(1, []byte("hello"))
+			Convey("Then it should pass through to the handlers", func() {
+				So(<-h.texts, ShouldEqual, "hello")
+			})
+		})
+		Reset(func() {
+			<-done
+		})
+	})
+}
+
+func TestRequesterOptionalHandlers(t *testing.T) {
+	Convey("Given a Requester on handlers implementing optional interfaces", t, func() {
+		h := optionalHandlers{
+			appHandlers: appHandlers{texts: make(chan string, 1)},
+			reasons:     make(chan wsserver.OfflineReason, 1),
+		}
+		r := New(h)
+		r.SetConnCtrlr(&wsserver.RecordingConnController{})
+		Convey("'OnTextContext' should be forwarded for other messages", func() {
+			r.OnTextContext(context.Background(), 1, []byte("hi"))
+			So(<-h.texts, ShouldEqual, "ctx:hi")
+		})
+		Convey("'OnOfflineReason' should be forwarded", func() {
+			r.OnOfflineReason(1, wsserver.OfflineReason{Err: wsserver.ErrIdleTimeout})
+			So((<-h.reasons).Err, ShouldEqual, wsserver.ErrIdleTimeout)
+		})
+	})
+}
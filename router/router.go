@@ -0,0 +1,145 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/rosberry/go-wsserver"
+)
+
+type (
+	// Router dispatches JSON messages to typed handlers by their type and
+	// passes any other message to the application handlers. Pass it as
+	// wsserver.Config.Handlers. The optional handler interfaces of the
+	// application handlers are forwarded by wsserver.ForwardHandlers;
+	// routed messages arrive as text.
+	Router struct {
+		wsserver.ForwardHandlers
+
+		cc     wsserver.ConnController
+		mutex  sync.RWMutex
+		routes map[string]route
+	}
+
+	// Message is the wire format of routed messages and their responses.
+	Message struct {
+		Type    string          `json:"type"`
+		Payload json.RawMessage `json:"payload,omitempty"`
+		Error   string          `json:"error,omitempty"`
+	}
+
+	route struct {
+		fn      reflect.Value
+		payload reflect.Type
+	}
+)
+
+var (
+	ctxType   = reflect.TypeOf((*context.Context)(nil)).Elem()
+	uintType  = reflect.TypeOf(uint(0))
+	errorType = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+func New(h wsserver.Handlers) *Router {
+	return &Router{
+		ForwardHandlers: wsserver.ForwardHandlers{Handlers: h},
+		routes:          make(map[string]route),
+	}
+}
+
+// Handle registers fn for messages of type typ. fn must have the form
+//
+//	func(ctx context.Context, id uint, payload P) error
+//	func(ctx context.Context, id uint, payload P) (R, error)
+//
+// where the payload is unmarshaled into P. A returned R is written back as
+// a message of the same type, a returned error as its Error. ctx is the
+// one of OnTextContext, canceled when the connection closes.
+func (r *Router) Handle(typ string, fn interface{}) {
+	v := reflect.ValueOf(fn)
+	t := v.Type()
+	if t.Kind() != reflect.Func || t.NumIn() != 3 ||
+		t.In(0) != ctxType || t.In(1) != uintType ||
+		t.NumOut() < 1 || t.NumOut() > 2 || t.Out(t.NumOut()-1) != errorType {
+		panic(fmt.Sprintf("router: bad handler for %q: %s", typ, t))
+	}
+
+	r.mutex.Lock()
+	r.routes[typ] = route{fn: v, payload: t.In(2)}
+	r.mutex.Unlock()
+}
+
+func (r *Router) SetConnCtrlr(ctrlr wsserver.ConnController) {
+	r.cc = ctrlr
+	r.Handlers.SetConnCtrlr(ctrlr)
+}
+
+func (r *Router) OnText(id uint, msg []byte) {
+	if !r.route(context.Background(), id, msg) {
+		r.Handlers.OnText(id, msg)
+	}
+}
+
+// OnTextContext is OnText for application handlers implementing
+// wsserver.ContextTextHandlers.
+func (r *Router) OnTextContext(ctx context.Context, id uint, msg []byte) {
+	if r.route(ctx, id, msg) {
+		return
+	}
+	r.ForwardHandlers.OnTextContext(ctx, id, msg)
+}
+
+// route dispatches msg to the handler of its type, if any.
+func (r *Router) route(ctx context.Context, id uint, msg []byte) bool {
+	var m Message
+	if json.Unmarshal(msg, &m) != nil || m.Type == "" {
+		return false
+	}
+	r.mutex.RLock()
+	rt, ok := r.routes[m.Type]
+	r.mutex.RUnlock()
+	if !ok {
+		return false
+	}
+
+	resp, err := rt.call(ctx, id, m.Payload)
+	if resp == nil && err == nil {
+		return true
+	}
+	out := Message{Type: m.Type}
+	if err != nil {
+		out.Error = err.Error()
+	} else if out.Payload, err = json.Marshal(resp); err != nil {
+		out.Error = err.Error()
+	}
+	if b, err := json.Marshal(out); err == nil {
+		r.cc.WriteMessage(id, b)
+	}
+	return true
+}
+
+// call unmarshals payload and calls the handler, returning its response,
+// if any, and error.
+func (rt route) call(ctx context.Context, id uint, payload json.RawMessage) (resp interface{}, err error) {
+	p := reflect.New(rt.payload)
+	if len(payload) > 0 {
+		if err := json.Unmarshal(payload, p.Interface()); err != nil {
+			return nil, err
+		}
+	}
+	out := rt.fn.Call([]reflect.Value{
+		reflect.ValueOf(ctx),
+		reflect.ValueOf(id),
+		p.Elem(),
+	})
+	if e := out[len(out)-1]; !e.IsNil() {
+		return nil, e.Interface().(error)
+	}
+	if len(out) == 2 {
+		return out[0].Interface(), nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,165 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	wsserver "github.com/rosberry/go-wsserver"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// appHandlers record the texts the Router passes through.
+type appHandlers struct {
+	wsserver.NoopHandlers
+	texts chan string
+}
+
+func (h appHandlers) OnText(id uint, msg []byte) {
+	h.texts <- string(msg)
+}
+
+// optionalHandlers implement some optional handler interfaces the Router
+// forwards.
+type optionalHandlers struct {
+	appHandlers
+	reasons chan wsserver.OfflineReason
+}
+
+func (h optionalHandlers) OnTextContext(ctx context.Context, id uint, msg []byte) {
+	h.texts <- "ctx:" + string(msg)
+}
+
+func (h optionalHandlers) OnOfflineReason(id uint, reason wsserver.OfflineReason) {
+	h.reasons <- reason
+}
+
+type (
+	sumRequest struct {
+		A, B int
+	}
+
+	sumResponse struct {
+		Sum int
+	}
+)
+
+type ctxKey struct{}
+
+var errNegative = errors.New("Negative operand")
+
+// sent returns the Messages written to cc.
+func sent(cc *wsserver.RecordingConnController) (msgs []Message) {
+	for _, rec := range cc.Messages() {
+		var m Message
+		json.Unmarshal(rec.Msg, &m)
+		msgs = append(msgs, m)
+	}
+	return msgs
+}
+
+func TestRouter(t *testing.T) {
+	Convey("Given a Router with typed handlers", t, func() {
+		h := appHandlers{texts: make(chan string, 1)}
+		r := New(h)
+		cc := &wsserver.RecordingConnController{}
+		r.SetConnCtrlr(cc)
+		values := make(chan interface{}, 1)
+		r.Handle("sum", func(ctx context.Context, id uint, req sumRequest) (sumResponse, error) {
+			if req.A < 0 || req.B < 0 {
+				return sumResponse{}, errNegative
+			}
+			return sumResponse{Sum: req.A + req.B}, nil
+		})
+		r.Handle("notify", func(ctx context.Context, id uint, req sumRequest) error {
+			values <- ctx.Value(ctxKey{})
+			return nil
+		})
+		Convey("When a message of a handled type arrives", func() {
+			r.OnText(1, []byte(`{"type":"sum","payload":{"A":1,"B":2}}`))
+			Convey("Then its response should be written back with the type", func() {
+				msgs := sent(cc)
+				So(msgs, ShouldHaveLength, 1)
+				So(msgs[0].Type, ShouldEqual, "sum")
+				So(string(msgs[0].Payload), ShouldEqual, `{"Sum":3}`)
+				So(msgs[0].Error, ShouldBeEmpty)
+				So(cc.Messages()[0].ID, ShouldEqual, 1)
+				So(len(h.texts), ShouldEqual, 0)
+			})
+		})
+		Convey("When its handler fails", func() {
+			r.OnText(1, []byte(`{"type":"sum","payload":{"A":-1,"B":2}}`))
+			Convey("Then the error should be written back", func() {
+				msgs := sent(cc)
+				So(msgs, ShouldHaveLength, 1)
+				So(msgs[0].Error, ShouldEqual, errNegative.Error())
+				So(msgs[0].Payload, ShouldBeEmpty)
+			})
+		})
+		Convey("When its payload doesn't decode", func() {
+			r.OnText(1, []byte(`{"type":"sum","payload":{"A":"one"}}`))
+			Convey("Then the decode error should be written back", func() {
+				msgs := sent(cc)
+				So(msgs, ShouldHaveLength, 1)
+				So(msgs[0].Error, ShouldContainSubstring, "cannot unmarshal")
+			})
+		})
+		Convey("When a handler without a response succeeds", func() {
+			ctx := context.WithValue(context.Background(), ctxKey{}, "conn")
+			r.OnTextContext(ctx, 1, []byte(`{"type":"notify"}`))
+			Convey("Then it should get the connection's context", func() {
+				So(<-values, ShouldEqual, "conn")
+			})
+			Convey("Then nothing should be written back", func() {
+				So(cc.Messages(), ShouldBeEmpty)
+			})
+		})
+		Convey("When a message of an unknown type arrives", func() {
+			msg := `{"type":"unknown"}`
+			r.OnText(1, []byte(msg))
+			Convey("Then it should pass through to the handlers", func() {
+				So(<-h.texts, ShouldEqual, msg)
+				So(cc.Messages(), ShouldBeEmpty)
+			})
+		})
+		Convey("When a message without a type arrives", func() {
+			r.OnText(1, []byte("hello"))
+			Convey("Then it should pass through to the handlers", func() {
+				So(<-h.texts, ShouldEqual, "hello")
+			})
+		})
+		Convey("Registering a handler of a bad signature should panic", func() {
+			So(func() {
+				r.Handle("bad", func(id uint, req sumRequest) error { return nil })
+			}, ShouldPanic)
+			So(func() {
+				r.Handle("bad", func(ctx context.Context, id uint, req sumRequest) int { return 0 })
+			}, ShouldPanic)
+			So(func() { r.Handle("bad", "not a func") }, ShouldPanic)
+		})
+	})
+}
+
+func TestRouterOptionalHandlers(t *testing.T) {
+	Convey("Given a Router on handlers implementing optional interfaces", t, func() {
+		h := optionalHandlers{
+			appHandlers: appHandlers{texts: make(chan string, 1)},
+			reasons:     make(chan wsserver.OfflineReason, 1),
+		}
+		r := New(h)
+		r.SetConnCtrlr(&wsserver.RecordingConnController{})
+		Convey("'OnTextContext' should be forwarded for unrouted messages", func() {
+			r.OnTextContext(context.Background(), 1, []byte("hi"))
+			So(<-h.texts, ShouldEqual, "ctx:hi")
+		})
+		Convey("'OnOfflineReason' should be forwarded", func() {
+			r.OnOfflineReason(1, wsserver.OfflineReason{Err: wsserver.ErrIdleTimeout})
+			So((<-h.reasons).Err, ShouldEqual, wsserver.ErrIdleTimeout)
+		})
+		Convey("'OnAuth' should be used to authenticate", func() {
+			_, err := r.OnAuthRequest(wsserver.Request{}, "token")
+			So(err, ShouldEqual, wsserver.ErrAuthFailed)
+		})
+	})
+}
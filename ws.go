@@ -1,16 +1,29 @@
 package wsserver
 
 import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
 	"net/url"
 	"os"
+	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gobwas/ws"
 	"github.com/gobwas/ws/wsutil"
@@ -31,6 +44,9 @@ type (
 
 	Handlers interface {
 		SetConnCtrlr(ctrlr ConnController)
+		// OnAuth receives the AuthTokenKey query value, percent-decoded but
+		// with "+" kept as is, or the Authorization header credential.
+		// Binary tokens should be base64 encoded and decoded by OnAuth.
 		OnAuth(token string) (id uint, ok bool)
 		OnOnline(id uint)
 		OnText(id uint, msg []byte)
@@ -38,23 +54,655 @@ type (
 		OnOffline(id uint)
 	}
 
+	// ResponseHeaderHandlers may be implemented by Handlers to add headers
+	// to the 101 response of an authenticated connection, e.g. a session
+	// cookie. They are written after Config.ResponseHeader.
+	ResponseHeaderHandlers interface {
+		ResponseHeader(id uint, req Request) http.Header
+	}
+
+	// ReconnectHandlers may be implemented by Handlers to learn that id
+	// reconnected within OfflineGrace or ResumeTimeout, when neither
+	// OnOffline nor OnOnline fire.
+	ReconnectHandlers interface {
+		OnReconnect(id uint)
+	}
+
+	// OfflineReasonHandlers may be implemented by Handlers that need to
+	// know why a connection went offline, e.g. to tell an idle client from
+	// a failed one. OnOfflineReason is then called instead of OnOffline.
+	OfflineReasonHandlers interface {
+		OnOfflineReason(id uint, reason OfflineReason)
+	}
+
+	// OfflineReason tells why a connection went offline. Code is the close
+	// code sent by the server or received from the client, zero if there
+	// was none. Err is ErrIdleTimeout, ErrPingTimeout, ErrConnReplaced,
+	// ErrWriteErrors or the read error that ended the connection, if any.
+	OfflineReason struct {
+		Code ws.StatusCode
+		Err  error
+	}
+
+	// Tracer starts a span, e.g. an OpenTelemetry one, for the handshake,
+	// OnOnline, every OnText call and every data write. attrs holds the
+	// Attr keys known at the start; end is called with the error of the
+	// operation, if any.
+	Tracer interface {
+		StartSpan(name string, attrs map[string]interface{}) (end func(err error))
+	}
+
+	// Codec encodes the values of SendCodec and decodes text messages for
+	// ValueHandlers, e.g. JSONCodec or a protobuf one.
+	Codec interface {
+		Marshal(v interface{}) ([]byte, error)
+		Unmarshal(data []byte, v interface{}) error
+	}
+
+	// Clock creates the ping and idle timers of the read loop, so tests can
+	// fire them without waiting.
+	Clock interface {
+		NewTimer(d time.Duration) Timer
+	}
+
+	// Timer is the part of time.Timer used by the read loop.
+	Timer interface {
+		C() <-chan time.Time
+		Stop() bool
+		Reset(d time.Duration) bool
+	}
+
+	// PingIntervalHandlers may be implemented by Handlers to override
+	// TimeoutPing for the connection of id. It is called once per
+	// connection after authentication; zero keeps TimeoutPing.
+	PingIntervalHandlers interface {
+		PingInterval(id uint) time.Duration
+	}
+
+	// AuthErrHandlers may be implemented by Handlers to tell why a token is
+	// rejected, e.g. because it expired or its user is banned. OnAuthErr is
+	// then called instead of OnAuth and a non-nil error rejects the
+	// handshake with that error as reason.
+	AuthErrHandlers interface {
+		OnAuthErr(token string) (id uint, err error)
+	}
+
+	// RequestAuthHandlers may be implemented by Handlers that route by the
+	// handshake request, e.g. a room id in the path. OnAuthRequest is then
+	// called instead of OnAuthErr and OnAuth.
+	RequestAuthHandlers interface {
+		OnAuthRequest(req Request, token string) (id uint, err error)
+	}
+
+	// ContextTextHandlers may be implemented by Handlers to receive text
+	// messages with a context, canceled when the connection closes or after
+	// HandlerTimeout, that Reply writes to. OnTextContext is then called
+	// instead of OnText.
+	ContextTextHandlers interface {
+		OnTextContext(ctx context.Context, id uint, msg []byte)
+	}
+
+	// ValueHandlers may be implemented by Handlers to receive text messages
+	// decoded by Config.Codec. Each message is decoded into the value
+	// NewValue returns for id, typically a pointer to a new struct, and
+	// OnValue is then called instead of OnTextContext and OnText. Messages
+	// that fail to decode are logged, reported as EventError and dropped.
+	ValueHandlers interface {
+		NewValue(id uint) interface{}
+		OnValue(id uint, v interface{})
+	}
+
 	ConnController interface {
 		WriteMessage(id uint, msg []byte) (err error)
 		CloseConnection(id uint) (err error)
 	}
 
+	// AckController may be implemented by a ConnController with a
+	// MaxInFlight window, such as WS. Handlers tracking app-level acks,
+	// e.g. ack.Acker, write the messages to be acknowledged with WriteAcked
+	// and call Ack when a client acknowledges them.
+	AckController interface {
+		WriteAcked(id uint, msg []byte) (err error)
+		Ack(id uint, n int) (err error)
+	}
+
 	Config struct {
 		Addr     string
 		Handlers Handlers
 		Logger   Logger
+
+		// AuthFunc and the other function shortcuts serve simple services
+		// instead of Handlers, which must then be nil. AuthFunc is required
+		// unless AllowUnauthenticated is set, the others are optional; an
+		// unset SendFunc lets every message through. Use the WS returned by
+		// New as the ConnController.
+		AuthFunc    func(token string) (id uint, ok bool)
+		OnlineFunc  func(id uint)
+		TextFunc    func(id uint, msg []byte)
+		SendFunc    func(id uint, msg []byte) (ok bool)
+		OfflineFunc func(id uint)
+
+		// AllowUnauthenticated is for local development only: every
+		// connection gets the next id of a counter starting at 1 and OnAuth
+		// is never called, whatever token is sent. A warning is logged.
+		AllowUnauthenticated bool
+
+		// OnAccept is called for every accepted TCP connection before the
+		// handshake. Returning false closes the connection immediately.
+		OnAccept func(conn net.Conn) (allow bool)
+
+		// MaxOpenConns stops accepting while that many accepted connections,
+		// handshakes included, are open and waits for one to close, instead
+		// of accepting connections that can't be served, e.g. when file
+		// descriptors run out. Zero means no limit. Connections passed to
+		// HandleConn or UpgradeHandler aren't counted.
+		MaxOpenConns int
+
+		// PingAlways sends a ping every TimeoutPing regardless of inbound
+		// traffic and closes the connection if no pong arrives within
+		// TimeoutClose. By default pings are only sent after TimeoutPing of
+		// read inactivity.
+		PingAlways bool
+
+		// DecoupleOnline lets OnOffline of a connection run without waiting
+		// for its OnOnline to return, so handlers doing long work in
+		// OnOnline don't delay the offline cleanup. By default OnOffline
+		// always follows OnOnline. When set, OnOffline may run while, or even
+		// before, OnOnline of the same connection does, and OnOnline of a
+		// reconnection only waits for OnOffline of the previous connection,
+		// not for its OnOnline.
+		DecoupleOnline bool
+
+		// Upgrader is applied to the ws.Upgrader of every connection before
+		// the package's own OnRequest, OnHeader and OnBeforeUpgrade hooks are
+		// installed. Hooks set by Upgrader still run after the package's.
+		// Accepting permessage-deflate in its Extension hook enables
+		// compressed inbound messages, see CompressionEnabled.
+		Upgrader func(u *ws.Upgrader)
+
+		// ResponseHeader is written into every successful upgrade
+		// response, e.g. X-Server-Version.
+		ResponseHeader http.Header
+
+		// ResumeTimeout enables session resume. Every upgrade response then
+		// carries a ResumeTokenHeader, and a client reconnecting within
+		// ResumeTimeout of a disconnect, either with that token in the
+		// ResumeTokenKey query parameter or by authenticating as the same id,
+		// continues its session: neither OnOffline nor OnOnline fire.
+		ResumeTimeout time.Duration
+
+		// OfflineGrace defers OnOffline by that long after a disconnect and
+		// skips both OnOffline and OnOnline if the id connects again in
+		// time, so brief network drops don't churn presence. It is session
+		// resume by id only, without resume tokens, and is ignored if
+		// ResumeTimeout is set. Handlers implementing ReconnectHandlers are
+		// told about such reconnects.
+		OfflineGrace time.Duration
+
+		// OfflineBuffer keeps the last OfflineBuffer messages written with
+		// WriteMessage to an id that isn't connected, and OfflineTTL drops
+		// them after that long; zero keeps them until the id connects. They
+		// are written in order when it does, before OnOnline is called, and
+		// WriteMessage returns nil for them. Zero buffers nothing.
+		OfflineBuffer int
+		OfflineTTL    time.Duration
+
+		// Observe receives duration samples: ObserveOnText for the OnText
+		// handler, ObserveWrite for the socket write of WriteMessage and
+		// ObserveHandshake from accepting a connection to its upgrade. It is
+		// called synchronously, so it must be cheap.
+		Observe func(event string, d time.Duration)
+
+		// Tracer, if set, traces connections and messages.
+		Tracer Tracer
+
+		// Clock replaces the real clock for the ping and idle timers.
+		Clock Clock
+
+		// Codec is used by SendCodec and ValueHandlers. The default passes
+		// messages as is: it marshals []byte and string values and
+		// unmarshals into *[]byte and *string.
+		Codec Codec
+
+		// OrderedDelivery calls OnText for the messages of one connection
+		// sequentially and in arrival order; connections are still handled
+		// concurrently. A slow OnText then delays reading further frames of
+		// that connection, pings included, so throughput per connection is
+		// bounded by the handler. By default every message is dispatched in
+		// its own goroutine.
+		OrderedDelivery bool
+
+		// HealthAddr, if set, serves an HTTP health probe on a separate
+		// listener. It answers 200 with the connection count while the
+		// WebSocket listener accepts, and 503 after an accept error or
+		// during Shutdown, which closes the probe listener when done.
+		HealthAddr string
+
+		// AuthSchemes lists the schemes accepted in the Authorization
+		// header, e.g. "Token" for "Token <jwt>". Defaults to
+		// DefaultAuthSchemes.
+		AuthSchemes []string
+
+		// CoalesceWindow batches the messages written to a connection within
+		// the window into one newline-delimited text frame, so messages must
+		// not contain newlines themselves. WriteMessage then returns before the
+		// frame is written and write errors are only logged. Zero writes every
+		// message immediately.
+		CoalesceWindow time.Duration
+
+		// OnDrop is called for every message accepted by WriteMessage but
+		// never written, i.e. a CoalesceWindow batch whose write failed.
+		OnDrop func(id uint, msg []byte)
+
+		// OnAuthReject is called when a handshake is rejected for failed or
+		// missing authentication, with ErrBadAuthHeader, ErrAuthFailed,
+		// ErrNotAuth or the error of OnAuthErr as reason.
+		OnAuthReject func(remoteAddr string, reason error)
+
+		// MaxHandshakeHeaderBytes caps the total size of the non-WebSocket
+		// handshake headers. A handshake exceeding it is rejected with 431.
+		// Zero means no limit.
+		MaxHandshakeHeaderBytes int
+
+		// OnTextWorkers dispatches OnText to a fixed pool of that many
+		// goroutines shared by all connections, bounding handler concurrency.
+		// When all workers are busy, reading stalls until one is free. Zero
+		// starts a goroutine per message. Ignored with OrderedDelivery.
+		// Shutdown stops the workers and waits for them.
+		OnTextWorkers int
+
+		// InitialState is the state of new connections, StateReady by
+		// default. Handlers move a connection on with SetState, e.g. after
+		// the init frame of a two-phase protocol.
+		InitialState ConnState
+
+		// ConnShards splits the connection registry into that many
+		// independently locked shards by id, so lookups, connects and
+		// disconnects of unrelated ids don't contend. With ResumeTimeout
+		// connects still share the session lock. Defaults to
+		// DefaultConnShards.
+		ConnShards int
+
+		// OnReceive, if set, rewrites every text message before AcceptText
+		// and OnText, e.g. to decrypt it; false drops the message. It runs
+		// in the read loop of the connection.
+		OnReceive func(id uint, msg []byte) (out []byte, ok bool)
+
+		// AcceptText, if set, is asked for every text message whether it is
+		// accepted in the current state of the connection. Rejected messages
+		// are dropped without calling OnText.
+		AcceptText func(id uint, state ConnState, msg []byte) bool
+
+		// DuplicatePolicy decides what happens when an id that is already
+		// connected connects again. Defaults to ReplaceOld.
+		DuplicatePolicy DuplicatePolicy
+
+		// BroadcastWorkers bounds the concurrent writes of Broadcast.
+		// Defaults to DefaultBroadcastWorkers.
+		BroadcastWorkers int
+
+		// PanicPolicy decides how the server proceeds after a hook panics.
+		// Defaults to PanicFailClosed.
+		PanicPolicy PanicPolicy
+
+		// AuthProtocolPrefix, if set, authenticates with the first offered
+		// subprotocol having that prefix, e.g. "auth." for "auth.<token>",
+		// for browsers that can't set headers. The rest of the subprotocol is
+		// passed to OnAuth. The auth subprotocol is echoed back as negotiated
+		// unless Upgrader sets Protocol, which then selects among the
+		// subprotocols following it.
+		AuthProtocolPrefix string
+
+		// MaxMessagesPerSecond limits the text messages read from one
+		// connection per second; RateLimitAction decides what happens to
+		// the excess. Zero means no limit.
+		MaxMessagesPerSecond int
+		RateLimitAction      RateLimitAction
+
+		// OnRebind is called after Rebind moved a connection to a new id.
+		OnRebind func(oldID, newID uint)
+
+		// OnConnect is called for every connection once it is upgraded,
+		// authenticated and registered, resumed sessions included, e.g. for
+		// an audit log. It runs before OnOnline, which is meant for
+		// business logic, and delays the connection's first read.
+		OnConnect func(info ConnInfo)
+
+		// TCPReadBuffer and TCPWriteBuffer set the socket buffer sizes of
+		// accepted TCP connections before the handshake. Zero keeps the OS
+		// defaults.
+		TCPReadBuffer  int
+		TCPWriteBuffer int
+
+		// DisablePing stops server-initiated pings, for clients with their
+		// own heartbeat that don't answer them. Liveness is then left to
+		// IdleTimeout and TCP keepalive.
+		DisablePing bool
+
+		// IdleTimeout closes a connection with IdleCloseCode after that long
+		// without an inbound frame. Zero means no limit. IdleCloseCode
+		// defaults to 1001; an application code in the 4000-4999 range lets
+		// clients tell an idle close from an error.
+		IdleTimeout   time.Duration
+		IdleCloseCode ws.StatusCode
+
+		// EmptyTextKeepalive treats empty text frames as keepalives: they
+		// reset the idle timer but aren't rate limited or passed to OnText.
+		// By default they are dispatched like any other message.
+		EmptyTextKeepalive bool
+
+		// MaxFrameSize splits outbound text and binary messages into
+		// continuation frames of at most that many payload bytes, bounding
+		// what the client has to buffer per frame. Pings, pongs and close
+		// frames can go out between the frames of a message. WriteStream
+		// uses it as its buffer size. Zero sends every message in a single
+		// frame.
+		MaxFrameSize int
+
+		// MaxMessageSize closes a connection sending a message of more than
+		// that many bytes, after inflating it if compressed, with 1009
+		// (message too big). Zero means no limit.
+		MaxMessageSize int
+
+		// OnWriteError is called in its own goroutine for every failed write
+		// to a connection, whichever method wrote. MaxWriteErrors evicts a
+		// connection after that many failed writes in a row, even if reads
+		// still succeed: it is closed and unregistered, and OnOffline runs
+		// with ErrWriteErrors as reason. Zero never does.
+		OnWriteError   func(id uint, err error)
+		MaxWriteErrors int
+
+		// MaxInFlight is a sliding window for protocols with app-level acks:
+		// once that many messages written by WriteAcked to a connection
+		// are unacknowledged, further ones fail with ErrWindowFull until
+		// Ack is called for it, which ack.Acker does. Messages that fail to
+		// be written, in a CoalesceWindow batch too, free their slot. Other
+		// writes, e.g. WriteMessage, Reply and Broadcast, don't count. Zero
+		// doesn't limit.
+		MaxInFlight int
+
+		// WriteRetries retries a frame write failing with a temporary
+		// net.Error, e.g. EAGAIN, up to that many times, waiting
+		// WriteRetryBackoff, doubled on every retry, in between. A write is
+		// only retried if none of it reached the connection. Other errors
+		// aren't retried and a broken connection is closed as before.
+		WriteRetries int
+
+		// LogPayloads logs the payload of every inbound text message and
+		// outbound data message for debugging, after passing it through
+		// RedactFunc, if set, e.g. to mask secrets. RedactFunc gets a copy
+		// of the payload, so it may mask in place. Payloads are never
+		// logged by default. A panicking RedactFunc skips the line.
+		LogPayloads bool
+		RedactFunc  func(payload []byte) []byte
+
+		// QueryTokenValidator, if set, replaces the AuthTokenKey lookup for
+		// requests with a query. It validates the query, e.g. a token signed
+		// together with its expiry, and returns the token passed to OnAuth;
+		// false rejects the handshake with ErrAuthFailed.
+		QueryTokenValidator func(values url.Values) (token string, ok bool)
+
+		// HandlerTimeout cancels the context passed to OnTextContext after
+		// that long; OnText calls exceeding it are logged. Zero means no
+		// limit.
+		HandlerTimeout time.Duration
+
+		// ReadErrorCloseCode chooses the close frame sent when reading from a
+		// connection fails; zero sends none. Defaults to
+		// DefaultReadErrorCloseCode.
+		ReadErrorCloseCode func(err error) ws.StatusCode
+
+		// AuthRejection, if set, builds the HTTP response of a handshake
+		// rejected for failed or missing authentication from its reason, so
+		// clients can tell why, e.g. a JSON body. A zero status means 401.
+		// By default the response is a 500 with the reason as text.
+		AuthRejection func(reason error) (status int, body string)
+
+		// EventBuffer enables Events with a channel of that capacity.
+		// Events are dropped, and counted in Diagnostics, while the channel
+		// is full so a slow consumer never blocks a connection.
+		EventBuffer int
+	}
+
+	// EventType tags an Event.
+	EventType int
+
+	// Event is a lifecycle event delivered by Events, sent before the
+	// matching handler is called. Payload is set for EventText, Err for
+	// EventError.
+	Event struct {
+		Type    EventType
+		ID      uint
+		Payload []byte
+		Err     error
 	}
 
+	RateLimitAction int
+
+	PanicPolicy int
+
+	DuplicatePolicy int
+
+	// ConnState is the application-level state of a connection.
+	ConnState int32
+
 	WS struct {
-		conns map[uint]net.Conn
-		addr  string
-		h     Handlers
-		l     Logger
-		mutex *sync.RWMutex
+		events     chan Event
+		shards     []*connShard
+		ln         net.Listener
+		hln        net.Listener
+		addr       string
+		h          Handlers
+		l          Logger
+		mutex      *sync.RWMutex
+		onAccept   func(conn net.Conn) (allow bool)
+		pingAlways bool
+		upgrader   func(u *ws.Upgrader)
+
+		decoupleOnline bool
+
+		resumeTimeout time.Duration
+		resumeTokens  bool
+		sessions      map[uint]*session
+		resumes       map[string]uint
+		offlineBuffer int
+		offlineTTL    time.Duration
+		observe       func(event string, d time.Duration)
+		tracer        Tracer
+		clock         Clock
+		codec         Codec
+		allowAnon     bool
+		admit         chan struct{} // MaxOpenConns slots, nil without limit
+		ordered       bool
+		acceptErr     atomic.Value // string, last accept error or ""
+		authSchemes   []string
+
+		coalesceWindow time.Duration
+		onAuthReject   func(remoteAddr string, reason error)
+		maxHeaderBytes int
+		texts          chan text
+		textsMu        sync.RWMutex // held to send to texts, locked by Shutdown to close it
+		textsClosed    bool
+		workers        sync.WaitGroup
+		initialState   ConnState
+		acceptText     func(id uint, state ConnState, msg []byte) bool
+		duplicate      DuplicatePolicy
+		broadcasters   int
+		panicPolicy    PanicPolicy
+		authProtocol   string
+		maxRate        int
+		rateAction     RateLimitAction
+		onRebind       func(oldID, newID uint)
+		onConnect      func(info ConnInfo)
+		tcpReadBuffer  int
+		tcpWriteBuffer int
+		authRejection  func(reason error) (status int, body string)
+		disablePing    bool
+		idleTimeout    time.Duration
+		idleCloseCode  ws.StatusCode
+		emptyKeepalive bool
+		responseHeader http.Header
+		maxFrameSize   int
+		maxMessageSize int
+		onWriteError   func(id uint, err error)
+		maxWriteErrors int
+		maxInFlight    int32
+		writeRetries   int
+		logPayloads    bool
+		redact         func(payload []byte) []byte
+		readErrorCode  func(err error) ws.StatusCode
+		queryValidator func(values url.Values) (token string, ok bool)
+		handlerTimeout time.Duration
+		onReceive      func(id uint, msg []byte) (out []byte, ok bool)
+		onDrop         func(id uint, msg []byte)
+
+		closed   int32  // set by Shutdown, accessed atomically
+		draining int32  // set by Drain, accessed atomically
+		open     int64  // accessed atomically
+		waits    int64  // accessed atomically
+		anonID   uint64 // last id given with allowAnon, accessed atomically
+		readers  int64  // accessed atomically
+		handlers int64  // accessed atomically
+		dropped  int64  // events dropped, accessed atomically
+		received frameCounters
+		sent     frameCounters
+		hsStats  handshakeCounters
+	}
+
+	// Diagnostics is a snapshot of the server's goroutines for debugging
+	// leaks. More Readers than Conns means orphaned readers.
+	Diagnostics struct {
+		Conns      int // registered connections
+		Readers    int // goroutines reading a frame
+		Handlers   int // running OnOnline, OnText and OnOffline calls
+		Goroutines int // all goroutines of the process
+		Dropped    int // events dropped because the Events channel was full
+	}
+
+	// Stats counts the frames received and sent since the server started.
+	Stats struct {
+		Received FrameCounts
+		Sent     FrameCounts
+
+		OpenConns   int64 // accepted connections not closed yet
+		AcceptWaits int64 // times accepting waited for MaxOpenConns
+
+		Handshakes HandshakeStats
+	}
+
+	// HandshakeStats measures successful handshakes from accepting the
+	// connection to its upgrade, which includes OnAuth, so a slow auth
+	// backend shows here. Buckets counts them by HandshakeBuckets, the
+	// last one counting those slower than a second.
+	HandshakeStats struct {
+		Count   int64
+		Total   time.Duration
+		Buckets [len(handshakeBuckets) + 1]int64
+	}
+
+	// FrameCounts counts frames by opcode. A fragmented message, e.g. by
+	// WriteStream or MaxFrameSize, counts as one frame.
+	FrameCounts struct {
+		Text   int64
+		Binary int64
+		Ping   int64
+		Pong   int64
+		Close  int64
+	}
+
+	// frameCounters counts frames by opcode, accessed atomically.
+	frameCounters [16]int64
+
+	// handshakeCounters backs HandshakeStats, accessed atomically.
+	handshakeCounters struct {
+		count   int64
+		total   int64
+		buckets [len(handshakeBuckets) + 1]int64
+	}
+
+	// ConnInfo describes an established connection.
+	ConnInfo struct {
+		ID         uint
+		RemoteAddr string
+		Request    Request
+		Protocol   string   // negotiated subprotocol
+		Extensions []string // names of the negotiated extensions
+		Connected  time.Time
+		ConnID     string        // UUID generated at upgrade, unique per connection
+		LastRTT    time.Duration // between the last ping and its pong, 0 before
+	}
+
+	// Request is the handshake request of a connection.
+	Request struct {
+		Path     string
+		RawQuery string
+	}
+
+	// connShard holds the connections of the ids mapped to it and their
+	// per-id state. Its mutex alone guards connecting and disconnecting
+	// them, so unrelated ids don't contend; if w.mutex is needed too, it is
+	// locked first.
+	connShard struct {
+		mutex  sync.RWMutex
+		conns  map[uint]*client
+		last   map[uint]*client // latest client of id until its OnOffline
+		queued map[uint][]queued
+		bans   map[uint]time.Time
+	}
+
+	text struct {
+		ctx context.Context
+		c   *client
+		msg []byte
+	}
+
+	// client is an upgraded connection of id.
+	client struct {
+		net.Conn
+		id    uint64 // accessed atomically, see ID
+		req   Request
+		batch *batch
+
+		protocol   string
+		extensions []string
+		mmu        sync.Mutex // serializes data messages, held for a whole WriteStream
+		wmu        sync.Mutex // serializes frames, taken after mmu
+
+		paused    int32 // accessed atomically
+		writeErrs int32 // failed writes in a row, accessed atomically
+		evicted   int32 // set after MaxWriteErrors, accessed atomically
+		inFlight  int32 // unacked messages under MaxInFlight, accessed atomically
+		written   int64 // bytes written, accessed atomically
+		state     int32 // ConnState, accessed atomically
+		lastPong  int64 // unix nanoseconds, accessed atomically
+		rtt       int64 // time.Duration, accessed atomically
+		flow      chan struct{}
+		reason    OfflineReason // set by the read loop before it ends
+		connected time.Time
+		connID    string
+
+		online      sync.WaitGroup
+		offline     sync.Once
+		offlineDone chan struct{} // closed once OnOffline has returned
+		textsDone   chan struct{} // closed once the ordered OnText calls have returned
+	}
+
+	batch struct {
+		mutex sync.Mutex
+		msgs  [][]byte
+		acked int // msgs written by WriteAcked
+	}
+
+	session struct {
+		token   string
+		offline *time.Timer
+		client  *client // suspended client, while offline is pending
+	}
+
+	// queued is a message kept for an offline id.
+	queued struct {
+		msg []byte
+		at  time.Time
 	}
 
 	Message struct {
@@ -67,280 +715,2856 @@ type (
 const (
 	TimeoutPing  = 30 * time.Second
 	TimeoutClose = 15 * time.Second
+
+	WriteRetryBackoff = 10 * time.Millisecond
+)
+
+const (
+	StateReady ConnState = iota
+	StateUpgraded
+)
+
+const (
+	// ReplaceOld closes the existing connection of the id.
+	ReplaceOld DuplicatePolicy = iota
+	// RejectNew closes the new connection with 1008 (policy violation).
+	RejectNew
 )
 
+const (
+	// PanicFailClosed skips the action guarded by the hook: the connection
+	// is rejected, the message is not sent or not delivered.
+	PanicFailClosed PanicPolicy = iota
+	// PanicFailOpen goes ahead as if the hook allowed the action. A
+	// panicking OnAuth still rejects, as there is no id to accept.
+	PanicFailOpen
+	// PanicCloseConn skips the action and closes the connection of the id
+	// the hook was called for.
+	PanicCloseConn
+)
+
+const (
+	// RateLimitDrop drops messages over the limit.
+	RateLimitDrop RateLimitAction = iota
+	// RateLimitPause delivers the message over the limit and stops reading
+	// until the second is over.
+	RateLimitPause
+	// RateLimitClose closes the connection with 1008 (policy violation).
+	RateLimitClose
+)
+
+const (
+	// EventOnline is sent when a connection comes online.
+	EventOnline EventType = iota
+	// EventOffline is sent when a connection goes offline.
+	EventOffline
+	// EventText is sent for every text message passed to OnText.
+	EventText
+	// EventError is sent for read and write errors of a connection.
+	EventError
+)
+
+const orderedQueueSize = 64
+
+const DefaultBroadcastWorkers = 16
+
+const DefaultConnShards = 32
+
 const (
 	LoggerDefaultPrefix = "[WS]"
 	AuthTokenKey        = "token"
+	ResumeTokenKey      = "resume"
+	ResumeTokenHeader   = "X-Resume-Token"
+	ExtensionDeflate    = "permessage-deflate"
+)
+
+const (
+	ObserveOnText    = "OnText"
+	ObserveWrite     = "WriteMessage"
+	ObserveHandshake = "Handshake"
+)
+
+// handshakeBuckets are the upper bounds of the HandshakeStats buckets.
+var handshakeBuckets = [...]time.Duration{
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+// HandshakeBuckets returns the upper bounds of the HandshakeStats buckets.
+func HandshakeBuckets() []time.Duration {
+	return append([]time.Duration(nil), handshakeBuckets[:]...)
+}
+
+// Span names and attributes passed to Tracer.
+const (
+	SpanHandshake = "Handshake"
+	SpanOnOnline  = "OnOnline"
+	SpanOnText    = "OnText"
+	SpanWrite     = "Write"
+
+	AttrID         = "ws.id"
+	AttrRemoteAddr = "ws.remote_addr"
+	AttrBytes      = "ws.bytes"
+	AttrOpCode     = "ws.opcode"
 )
 
 var (
 	ErrEmptyConfig   = errors.New("Empty config")
+	ErrNoHandlers    = errors.New("No handlers")
 	ErrBadAuthHeader = errors.New("Bad Authorization header")
 	ErrAuthFailed    = errors.New("Bad token")
 	ErrNotAuth       = errors.New("Token not found")
 	ErrConnNotFound  = errors.New("Connection not found")
+	ErrConnClosed    = errors.New("Connection closed")
+	ErrListen        = errors.New("Listen failed")
+	ErrIDInUse       = errors.New("Connection id in use")
+	ErrZeroID        = errors.New("Zero connection id")
+	ErrIDBanned      = errors.New("Connection id banned")
+	ErrNilListener   = errors.New("Nil listener")
+	ErrIdleTimeout   = errors.New("Idle timeout")
+	ErrPingTimeout   = errors.New("Ping timeout")
+	ErrConnReplaced  = errors.New("Connection replaced")
+	ErrWriteErrors   = errors.New("Too many write errors")
+	ErrNotControl    = errors.New("Not a control frame")
+	ErrControlSize   = errors.New("Control frame payload over 125 bytes")
+	ErrInflate       = ws.ProtocolError("invalid compressed message")
+	ErrMessageTooBig = errors.New("Message too big")
+	ErrNoReply       = errors.New("No connection to reply to")
+	ErrWindowFull    = errors.New("Too many unacked messages")
+	ErrServerClosed  = errors.New("Server closed")
+	ErrCodecType     = errors.New("Raw codec takes []byte or string")
+
+	ErrHeadersTooLarge = ws.RejectConnectionError(
+		ws.RejectionStatus(http.StatusRequestHeaderFieldsTooLarge),
+		ws.RejectionReason("Request header fields too large"),
+	)
+	ErrDraining = ws.RejectConnectionError(
+		ws.RejectionStatus(http.StatusServiceUnavailable),
+		ws.RejectionReason("Server draining"),
+	)
 )
 
+var errNilAddr = errors.New("nil address")
+
+var DefaultAuthSchemes = []string{"Bearer", "Basic"}
+
+// ListenError is returned by Start when an address can't be listened on.
+// It matches ErrListen with errors.Is and unwraps to the *net.OpError.
+type ListenError struct {
+	Network string
+	Addr    string
+	Err     error
+}
+
+func (e *ListenError) Error() string {
+	return ErrListen.Error() + " on " + e.Network + " " + e.Addr + ": " + e.Err.Error()
+}
+
+func (e *ListenError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ListenError) Is(target error) bool {
+	return target == ErrListen
+}
+
+func listen(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, &ListenError{Network: "tcp", Addr: addr, Err: err}
+	}
+	return ln, nil
+}
+
+type healthStatus struct {
+	Listening   bool   `json:"listening"`
+	Connections int    `json:"connections"`
+	Error       string `json:"error,omitempty"`
+}
+
+// Start creates the server and listens on cfg.Addr.
 func Start(cfg *Config) (*WS, error) {
+	w, err := New(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	ln, err := listen(cfg.Addr)
+	if err != nil {
+		w.l.Printf("Websocket listen error: %s", err)
+		return nil, err
+	}
+	w.addr = ln.Addr().String()
+	w.l.Printf("Websocket is listening on %s", addrString(ln.Addr()))
+
+	if cfg.HealthAddr != "" {
+		hln, err := listen(cfg.HealthAddr)
+		if err != nil {
+			w.l.Printf("Health probe listen error: %s", err)
+			ln.Close()
+			return nil, err
+		}
+		w.l.Printf("Health probe is listening on %s", addrString(hln.Addr()))
+		w.hln = hln
+		go func() {
+			if err := http.Serve(hln, http.HandlerFunc(w.serveHealth)); err != nil && !w.isClosed() {
+				w.l.Printf("Health probe error: %s", err)
+			}
+		}()
+	}
+
+	w.ln = ln
+	go w.serve(ln)
+
+	return w, nil
+}
+
+// serve accepts connections from ln until Relisten replaces it.
+func (w *WS) serve(ln net.Listener) {
+	var delay time.Duration
+	for {
+		w.acquire()
+		conn, err := ln.Accept()
+		if err != nil {
+			w.release()
+			if !w.listening(ln) {
+				// Shutdown or Relisten closed ln.
+				return
+			}
+		}
+		w.setAcceptErr(err)
+		if isClosedConnError(err) {
+			// ln was closed by its owner, it won't accept again.
+			w.l.Printf("Listener %s closed, stopped accepting", addrString(ln.Addr()))
+			return
+		}
+		if err == nil {
+			delay = 0
+			if !w.onAcceptWrapper(conn) {
+				conn.Close()
+				w.release()
+				continue
+			}
+			atomic.AddInt64(&w.open, 1)
+			go func() {
+				defer w.release()
+				defer atomic.AddInt64(&w.open, -1)
+				w.handle(conn)
+			}()
+		} else {
+			w.l.Printf("Start connection error: %s", err)
+			// Back off like net/http so that failing accepts, e.g. out
+			// of file descriptors, don't spin.
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > time.Second {
+				delay = time.Second
+			}
+			time.Sleep(delay)
+		}
+	}
+}
+
+// acquire takes a MaxOpenConns slot for the next accepted connection,
+// waiting for one to be released if all are taken.
+func (w *WS) acquire() {
+	if w.admit == nil {
+		return
+	}
+	select {
+	case w.admit <- struct{}{}:
+	default:
+		atomic.AddInt64(&w.waits, 1)
+		w.l.Printf("%d connections open, waiting to accept", cap(w.admit))
+		w.admit <- struct{}{}
+	}
+}
+
+func (w *WS) release() {
+	if w.admit != nil {
+		<-w.admit
+	}
+}
+
+func (w *WS) listening(ln net.Listener) bool {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	return w.ln == ln
+}
+
+// Relisten moves accepting to ln, e.g. after a certificate or port change,
+// and closes the previous listener. Established connections stay open.
+func (w *WS) Relisten(ln net.Listener) error {
+	if ln == nil {
+		return ErrNilListener
+	}
+	w.mutex.Lock()
+	old := w.ln
+	w.ln = ln
+	w.addr = ln.Addr().String()
+	w.mutex.Unlock()
+
+	w.setAcceptErr(nil)
+	w.l.Printf("Websocket is listening on %s", addrString(ln.Addr()))
+	go w.serve(ln)
+	if old != nil {
+		return old.Close()
+	}
+	return nil
+}
+
+// New creates the server without a listener. Connections are then passed
+// to HandleConn, e.g. the ends of net.Pipe in tests.
+func New(cfg *Config) (*WS, error) {
 	if cfg == nil {
 		return nil, ErrEmptyConfig
 	}
 	if cfg.Logger == nil {
 		cfg.Logger = log.New(os.Stdout, LoggerDefaultPrefix, log.Ldate|log.Ltime|log.LUTC)
 	}
+	if cfg.Handlers == nil {
+		if cfg.AuthFunc == nil && !cfg.AllowUnauthenticated {
+			return nil, ErrNoHandlers
+		}
+		cfg.Handlers = newFuncHandlers(cfg)
+	}
 
 	w := WS{
-		conns: make(map[uint]net.Conn),
-		h:     cfg.Handlers,
-		l:     cfg.Logger,
-		mutex: &sync.RWMutex{},
+		h:          cfg.Handlers,
+		l:          cfg.Logger,
+		mutex:      &sync.RWMutex{},
+		onAccept:   cfg.OnAccept,
+		pingAlways: cfg.PingAlways,
+		upgrader:   cfg.Upgrader,
+
+		decoupleOnline: cfg.DecoupleOnline,
+
+		resumeTimeout: cfg.ResumeTimeout,
+		resumeTokens:  cfg.ResumeTimeout > 0,
+		sessions:      make(map[uint]*session),
+		resumes:       make(map[string]uint),
+		offlineBuffer: cfg.OfflineBuffer,
+		offlineTTL:    cfg.OfflineTTL,
+		observe:       cfg.Observe,
+		tracer:        cfg.Tracer,
+		clock:         cfg.Clock,
+		codec:         cfg.Codec,
+		allowAnon:     cfg.AllowUnauthenticated,
+		ordered:       cfg.OrderedDelivery,
+		authSchemes:   cfg.AuthSchemes,
+
+		coalesceWindow: cfg.CoalesceWindow,
+		onAuthReject:   cfg.OnAuthReject,
+		maxHeaderBytes: cfg.MaxHandshakeHeaderBytes,
+		initialState:   cfg.InitialState,
+		acceptText:     cfg.AcceptText,
+		duplicate:      cfg.DuplicatePolicy,
+		broadcasters:   cfg.BroadcastWorkers,
+		panicPolicy:    cfg.PanicPolicy,
+		authProtocol:   cfg.AuthProtocolPrefix,
+		maxRate:        cfg.MaxMessagesPerSecond,
+		rateAction:     cfg.RateLimitAction,
+		onRebind:       cfg.OnRebind,
+		onConnect:      cfg.OnConnect,
+		tcpReadBuffer:  cfg.TCPReadBuffer,
+		tcpWriteBuffer: cfg.TCPWriteBuffer,
+		authRejection:  cfg.AuthRejection,
+		disablePing:    cfg.DisablePing,
+		idleTimeout:    cfg.IdleTimeout,
+		idleCloseCode:  cfg.IdleCloseCode,
+		emptyKeepalive: cfg.EmptyTextKeepalive,
+		responseHeader: cfg.ResponseHeader,
+		maxFrameSize:   cfg.MaxFrameSize,
+		maxMessageSize: cfg.MaxMessageSize,
+		onWriteError:   cfg.OnWriteError,
+		maxWriteErrors: cfg.MaxWriteErrors,
+		maxInFlight:    int32(cfg.MaxInFlight),
+		writeRetries:   cfg.WriteRetries,
+		logPayloads:    cfg.LogPayloads,
+		redact:         cfg.RedactFunc,
+		readErrorCode:  cfg.ReadErrorCloseCode,
+		queryValidator: cfg.QueryTokenValidator,
+		handlerTimeout: cfg.HandlerTimeout,
+		onReceive:      cfg.OnReceive,
+		onDrop:         cfg.OnDrop,
+	}
+	if cfg.EventBuffer > 0 {
+		w.events = make(chan Event, cfg.EventBuffer)
+	}
+	if cfg.MaxOpenConns > 0 {
+		w.admit = make(chan struct{}, cfg.MaxOpenConns)
+	}
+	shards := cfg.ConnShards
+	if shards <= 0 {
+		shards = DefaultConnShards
+	}
+	w.shards = make([]*connShard, shards)
+	for i := range w.shards {
+		w.shards[i] = &connShard{
+			conns:  make(map[uint]*client),
+			last:   make(map[uint]*client),
+			queued: make(map[uint][]queued),
+			bans:   make(map[uint]time.Time),
+		}
+	}
+	if w.broadcasters <= 0 {
+		w.broadcasters = DefaultBroadcastWorkers
+	}
+	if w.authSchemes == nil {
+		w.authSchemes = DefaultAuthSchemes
+	}
+	if w.readErrorCode == nil {
+		w.readErrorCode = DefaultReadErrorCloseCode
+	}
+	if w.clock == nil {
+		w.clock = realClock{}
+	}
+	if w.codec == nil {
+		w.codec = rawCodec{}
+	}
+	if w.resumeTimeout <= 0 {
+		w.resumeTimeout = cfg.OfflineGrace
+	}
+	if w.allowAnon {
+		w.l.Print("WARNING: AllowUnauthenticated is set, connections are not authenticated")
+	}
+	if w.idleCloseCode == 0 {
+		w.idleCloseCode = ws.StatusGoingAway
+	}
+	if cfg.OnTextWorkers > 0 {
+		w.texts = make(chan text, cfg.OnTextWorkers)
+		w.workers.Add(cfg.OnTextWorkers)
+		for i := 0; i < cfg.OnTextWorkers; i++ {
+			go func() {
+				defer w.workers.Done()
+				for t := range w.texts {
+					w.onTextWrapper(t.ctx, t.c, t.msg)
+				}
+			}()
+		}
 	}
 
-	ln, err := net.Listen("tcp", cfg.Addr)
-	if err != nil {
-		return nil, err
+	cfg.Handlers.SetConnCtrlr(&w)
+	return &w, nil
+}
+
+// HandleConn serves conn, from the handshake on, until it is closed.
+func (w *WS) HandleConn(conn net.Conn) {
+	w.handle(conn)
+}
+
+// UpgradeHandler serves WebSocket upgrades on an existing http.Server, e.g.
+// at "/ws" next to REST routes. The connection is hijacked and handled like
+// an accepted one, the handshake request being replayed to the upgrader.
+func (w *WS) UpgradeHandler() http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		hj, ok := rw.(http.Hijacker)
+		if !ok {
+			http.Error(rw, "Upgrade not supported", http.StatusInternalServerError)
+			return
+		}
+		conn, brw, err := hj.Hijack()
+		if err != nil {
+			w.l.Printf("Hijack error: %s", err)
+			return
+		}
+		// Deadlines of the http.Server don't apply to WebSocket connections.
+		conn.SetDeadline(time.Time{})
+		if !w.onAcceptWrapper(conn) {
+			conn.Close()
+			return
+		}
+		w.setBuffers(conn)
+
+		var req bytes.Buffer
+		fmt.Fprintf(&req, "%s %s HTTP/1.1\r\nHost: %s\r\n", r.Method, r.RequestURI, r.Host)
+		r.Header.Write(&req)
+		req.WriteString("\r\n")
+		w.handle(&replayConn{Conn: conn, r: io.MultiReader(&req, brw.Reader)})
 	}
-	w.addr = ln.Addr().String()
-	w.l.Printf("Websocket is listening on %s", w.addr)
+}
 
-	go func() {
-		for {
-			if conn, err := ln.Accept(); err == nil {
-				go w.handle(conn)
-			} else {
-				w.l.Printf("Start connection error: %s", err)
-			}
+// replayConn is a hijacked conn whose reads start with its replayed
+// handshake request.
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// setBuffers applies TCPReadBuffer and TCPWriteBuffer to a TCP conn.
+func (w *WS) setBuffers(conn net.Conn) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if w.tcpReadBuffer > 0 {
+		if err := tc.SetReadBuffer(w.tcpReadBuffer); err != nil {
+			w.l.Printf("Set read buffer error: %s", err)
+		}
+	}
+	if w.tcpWriteBuffer > 0 {
+		if err := tc.SetWriteBuffer(w.tcpWriteBuffer); err != nil {
+			w.l.Printf("Set write buffer error: %s", err)
+		}
+	}
+}
+
+func (w *WS) setAcceptErr(err error) {
+	if err != nil {
+		w.acceptErr.Store(err.Error())
+	} else if e, _ := w.acceptErr.Load().(string); e != "" {
+		w.acceptErr.Store("")
+	}
+}
+
+func (w *WS) serveHealth(rw http.ResponseWriter, r *http.Request) {
+	e, _ := w.acceptErr.Load().(string)
+	st := healthStatus{
+		Listening:   e == "",
+		Connections: w.connCount(),
+		Error:       e,
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if !st.Listening {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(rw).Encode(st)
+}
+
+func (w *WS) handle(conn net.Conn) {
+	start := time.Now()
+	defer conn.Close()
+	w.setBuffers(conn)
+	var id uint
+	var resumeToken string
+	var headerBytes int
+	var authErr error
+	var req Request
+
+	u := ws.Upgrader{}
+	if w.upgrader != nil {
+		w.upgrader(&u)
+	}
+	onRequest, onHeader, onBeforeUpgrade := u.OnRequest, u.OnHeader, u.OnBeforeUpgrade
+
+	if prefix := w.authProtocol; prefix != "" {
+		protocol := u.Protocol
+		u.Protocol = func(p []byte) bool {
+			if id == 0 && authErr == nil && strings.HasPrefix(string(p), prefix) {
+				id, authErr = w.onAuthWrapper(req, string(p[len(prefix):]))
+				return authErr == nil && protocol == nil
+			}
+			return protocol != nil && protocol(p)
+		}
+	}
+
+	u.OnRequest = func(uri []byte) error {
+		if w.isDraining() {
+			// Before OnAuth, so draining doesn't authenticate anyone.
+			return ErrDraining
+		}
+		if u, err := url.Parse(string(uri)); err == nil {
+			req = Request{Path: u.Path, RawQuery: u.RawQuery}
+		}
+		if req.RawQuery != "" {
+			if token, ok := queryParam(req.RawQuery, ResumeTokenKey); ok {
+				id, _ = w.resumeID(token)
+			}
+			token, ok := queryParam(req.RawQuery, AuthTokenKey)
+			if w.queryValidator != nil && id == 0 {
+				if token, ok = w.queryTokenValidatorWrapper(req.RawQuery); !ok {
+					authErr = ErrAuthFailed
+					return w.rejectAuth(authErr)
+				}
+			}
+			if ok && id == 0 {
+				if id, authErr = w.onAuthWrapper(req, token); authErr != nil {
+					return w.rejectAuth(authErr)
+				}
+			}
+		}
+		if onRequest != nil {
+			return onRequest(uri)
+		}
+		return nil
+	}
+	u.OnHeader = func(key, value []byte) error {
+		if w.maxHeaderBytes > 0 {
+			if headerBytes += len(key) + len(value); headerBytes > w.maxHeaderBytes {
+				return ErrHeadersTooLarge
+			}
+		}
+		if id == 0 && string(key) == "Authorization" {
+			token, ok := w.authCredential(string(value))
+			if !ok {
+				authErr = ErrBadAuthHeader
+				return w.rejectAuth(authErr)
+			}
+			if id, authErr = w.onAuthWrapper(req, token); authErr != nil {
+				return w.rejectAuth(authErr)
+			}
+		}
+		if onHeader != nil {
+			return onHeader(key, value)
+		}
+		return nil
+	}
+	u.OnBeforeUpgrade = func() (header ws.HandshakeHeader, err error) {
+		if w.allowAnon && id == 0 {
+			id, authErr = w.anonymousID(), nil
+		}
+		if authErr == nil && id == 0 {
+			authErr = ErrNotAuth
+		}
+		if authErr != nil {
+			return nil, w.rejectAuth(authErr)
+		}
+		var headers handshakeHeaders
+		if onBeforeUpgrade != nil {
+			if header, err = onBeforeUpgrade(); err != nil {
+				return
+			}
+			if header != nil {
+				headers = append(headers, header)
+			}
+		}
+		if w.responseHeader != nil {
+			headers = append(headers, ws.HandshakeHeaderHTTP(w.responseHeader))
+		}
+		if h := w.responseHeaderWrapper(id, req); h != nil {
+			headers = append(headers, ws.HandshakeHeaderHTTP(h))
+		}
+		if w.resumeTokens {
+			if resumeToken, err = newResumeToken(); err != nil {
+				return nil, err
+			}
+			headers = append(headers, ws.HandshakeHeaderHTTP(http.Header{
+				ResumeTokenHeader: []string{resumeToken},
+			}))
+		}
+		switch len(headers) {
+		case 0:
+			return nil, nil
+		case 1:
+			return headers[0], nil
+		}
+		return headers, nil
+	}
+	end := w.span(SpanHandshake, AttrRemoteAddr, addrString(conn.RemoteAddr()))
+	hs, err := u.Upgrade(conn)
+	end(err)
+	if err == nil {
+		w.hsStats.add(time.Since(start))
+		w.observeSince(ObserveHandshake, start)
+		c := &client{
+			Conn:        conn,
+			id:          uint64(id),
+			req:         req,
+			protocol:    hs.Protocol,
+			extensions:  extensionNames(hs),
+			flow:        make(chan struct{}, 1),
+			state:       int32(w.initialState),
+			lastPong:    time.Now().UnixNano(),
+			offlineDone: make(chan struct{}),
+			textsDone:   make(chan struct{}),
+			connected:   time.Now(),
+			connID:      newConnID(),
+		}
+		if w.coalesceWindow > 0 {
+			c.batch = &batch{}
+		}
+
+		s, unlock := w.lockID(id)
+		if w.isClosed() {
+			unlock()
+			w.closeConn(c, ws.StatusGoingAway, "Server shutdown")
+			return
+		}
+		if w.isDraining() {
+			// Drain was called during the handshake.
+			unlock()
+			w.closeConn(c, ws.StatusGoingAway, "Server draining")
+			return
+		}
+		if w.banned(s, id) {
+			unlock()
+			w.closeConn(c, ws.StatusPolicyViolation, "Banned")
+			return
+		}
+		existConn, replaced := s.conns[id]
+		if replaced && w.duplicate == RejectNew {
+			unlock()
+			w.closeConn(c, ws.StatusPolicyViolation, "Already connected")
+			return
+		}
+		if replaced {
+			err := existConn.Close()
+			if err != nil {
+				w.l.Print("Close connection err:", err)
+			}
+		}
+		s.conns[id] = c
+		prev := s.last[id]
+		s.last[id] = c
+		resumed := w.resumeSession(id, resumeToken)
+		queued := w.takeQueued(s, id)
+		unlock()
+
+		w.onConnectWrapper(c)
+		if replaced {
+			// OnOffline of existConn waits for its OnText calls, so it
+			// runs off the goroutine of this connection.
+			go existConn.offline.Do(func() {
+				w.waitOnline(existConn)
+				<-existConn.textsDone
+				w.onOfflineWrapper(existConn.ID(), OfflineReason{Err: ErrConnReplaced})
+				w.offlineDone(existConn)
+			})
+		}
+		if !resumed {
+			c.online.Add(1)
+			go func() {
+				// OnOffline of the previous connection of id, if still
+				// pending, completes before OnOnline of this one.
+				if prev != nil {
+					<-prev.offlineDone
+				}
+				w.writeQueued(c, queued)
+				w.onOnlineWrapper(c)
+			}()
+		} else {
+			go func() {
+				w.onReconnectWrapper(c.ID())
+				w.writeQueued(c, queued)
+			}()
+		}
+
+		// ctx is passed to OnTextContext and canceled once the connection
+		// is closed.
+		ctx, cancel := context.WithCancel(context.WithValue(context.Background(), replyKey{}, replier{w, c}))
+		var texts chan []byte
+		if w.ordered {
+			texts = make(chan []byte, orderedQueueSize)
+			go func() {
+				defer close(c.textsDone)
+				for msg := range texts {
+					w.onTextWrapper(ctx, c, msg)
+				}
+			}()
+		} else {
+			close(c.textsDone)
+		}
+
+		// chMsg is buffered so a pending reader can always deliver its
+		// result and exit, even after the loop below has finished.
+		chMsg := make(chan Message, 1)
+		reading := false
+		limiter := rateLimiter{max: w.maxRate}
+		var throttle <-chan time.Time
+		afterPing := false
+		var pingSent time.Time
+		pingInterval := w.pingIntervalWrapper(id)
+		to := w.clock.NewTimer(pingInterval)
+		pingC := to.C()
+		if w.disablePing {
+			to.Stop()
+			pingC = nil
+		}
+		var idle Timer
+		var idleC <-chan time.Time
+		if w.idleTimeout > 0 {
+			idle = w.clock.NewTimer(w.idleTimeout)
+			defer idle.Stop()
+			idleC = idle.C()
+		}
+
+		var inf *inflater
+		if c.deflate() {
+			inf = &inflater{}
+		}
+
+	ReadLoop:
+		for {
+			if !reading && !c.isPaused() && throttle == nil {
+				go w.read(c, chMsg, inf)
+				reading = true
+			}
+			select {
+			case <-c.flow:
+			case <-throttle:
+				throttle = nil
+			case msg := <-chMsg:
+				reading = false
+				if msg.Err == nil {
+					w.received.add(msg.Op)
+					switch msg.Op {
+					case ws.OpPing:
+						// readMessage has answered it with a pong.
+						w.sent.add(ws.OpPong)
+					case ws.OpPong:
+						atomic.StoreInt64(&c.lastPong, time.Now().UnixNano())
+						if afterPing {
+							atomic.StoreInt64(&c.rtt, int64(time.Since(pingSent)))
+						}
+					case ws.OpText:
+						if w.emptyKeepalive && len(msg.Body) == 0 || w.isDraining() {
+							break
+						}
+						if w.maxRate > 0 && !limiter.allow(time.Now()) {
+							if w.rateAction == RateLimitClose {
+								w.closeConn(c, ws.StatusPolicyViolation, "Rate limit exceeded")
+								c.reason = OfflineReason{Code: ws.StatusPolicyViolation}
+								break ReadLoop
+							}
+							if w.rateAction == RateLimitDrop {
+								break
+							}
+							throttle = time.After(limiter.remaining(time.Now()))
+						}
+						w.logPayload(c, "Received", msg.Body)
+						body, ok := w.onReceiveWrapper(c, msg.Body)
+						switch {
+						case !ok:
+						case !w.acceptTextWrapper(c, body):
+						case w.ordered:
+							texts <- body
+						case w.texts != nil:
+							w.dispatchText(text{ctx: ctx, c: c, msg: body})
+						default:
+							go w.onTextWrapper(ctx, c, body)
+						}
+					case ws.OpClose:
+						break ReadLoop
+					default:
+						w.l.Printf("[%s] Unknown received, OpCode: %v\n", c.logID(), msg.Op)
+					}
+					// With PingAlways only a pong answering our ping restarts
+					// the interval, otherwise any inbound frame does.
+					if pingC != nil && (!w.pingAlways || (afterPing && msg.Op == ws.OpPong)) {
+						if !to.Stop() {
+							<-to.C()
+						}
+						afterPing = false
+						to.Reset(pingInterval)
+					}
+					if idle != nil {
+						if !idle.Stop() {
+							<-idle.C()
+						}
+						idle.Reset(w.idleTimeout)
+					}
+				} else {
+					c.reason.Err = msg.Err
+					if atomic.LoadInt32(&c.evicted) == 1 {
+						c.reason.Err = ErrWriteErrors
+					}
+					if e, ok := msg.Err.(wsutil.ClosedError); ok {
+						// readMessage has echoed the close frame.
+						w.received.add(ws.OpClose)
+						w.sent.add(ws.OpClose)
+						c.reason.Code = e.Code
+					}
+					if !isCleanClose(msg.Err) {
+						w.l.Printf("[%s] read error: %s\n", c.logID(), msg.Err)
+						w.emit(Event{Type: EventError, ID: c.ID(), Err: msg.Err})
+					}
+					if code := w.readErrorCloseCode(msg.Err); code != 0 {
+						// A protocol error tells the client what it did wrong.
+						reason := ""
+						if e, ok := msg.Err.(ws.ProtocolError); ok {
+							reason = string(e)
+						}
+						w.closeConn(c, code, reason)
+						c.reason.Code = code
+					}
+					break ReadLoop //EOF
+				}
+			case <-idleC:
+				if c.isPaused() {
+					idle.Reset(w.idleTimeout)
+				} else {
+					w.l.Printf("[%s] Idle timeout...\n", c.logID())
+					w.closeConn(c, w.idleCloseCode, "Idle timeout")
+					c.reason = OfflineReason{Code: w.idleCloseCode, Err: ErrIdleTimeout}
+					break ReadLoop
+				}
+			case <-pingC:
+				if c.isPaused() || w.isClosed() {
+					// A paused connection can't read pongs, so it isn't
+					// pinged until resumed, nor is any during Shutdown.
+					afterPing = false
+					to.Reset(pingInterval)
+				} else if !afterPing {
+					pingSent = time.Now()
+					go w.writeFrame(c, ws.OpPing, []byte{})
+					afterPing = true
+					to.Reset(TimeoutClose)
+				} else {
+					w.l.Printf("[%s] Ping timeout...\n", c.logID())
+					w.closeConn(c, ws.StatusProtocolError, "")
+					c.reason = OfflineReason{Code: ws.StatusProtocolError, Err: ErrPingTimeout}
+					break ReadLoop
+				}
+			}
+		}
+		cancel()
+		if w.ordered {
+			close(texts)
+		}
+
+		s, id := w.lockClient(c)
+		current := s.conns[id] == c
+		if current {
+			delete(s.conns, id)
+		}
+		s.mutex.Unlock()
+
+		// OnOffline fires exactly once per connection, either here or by the
+		// connection replacing this one.
+		c.offline.Do(func() {
+			w.waitOnline(c)
+			<-c.textsDone
+
+			if !current || w.resumeTimeout <= 0 || !w.suspendSession(c) {
+				w.onOfflineWrapper(id, c.reason)
+				w.offlineDone(c)
+			}
+		})
+	} else {
+		w.l.Printf("%s: upgrade error: %v", nameConn(conn), err)
+		if authErr != nil {
+			w.onAuthRejectWrapper(addrString(conn.RemoteAddr()), authErr)
+		}
+	}
+}
+
+// read reads the next message of c. Pongs and close frames answering the
+// client are written under the frame lock of c.
+func (w *WS) read(c *client, chMsg chan Message, inf *inflater) {
+	atomic.AddInt64(&w.readers, 1)
+	defer atomic.AddInt64(&w.readers, -1)
+	readMessage(struct {
+		io.Reader
+		io.Writer
+	}{c.Conn, lockedWriter{c}}, chMsg, inf, w.maxMessageSize)
+}
+
+// lockedWriter writes to a client under its frame lock. wsutil writes
+// control frames and the fragments of wsutil.Writer in a single Write, so
+// they can't interleave with other frames.
+type lockedWriter struct {
+	c *client
+}
+
+func (lw lockedWriter) Write(p []byte) (int, error) {
+	lw.c.wmu.Lock()
+	defer lw.c.wmu.Unlock()
+	return lw.c.Write(p)
+}
+
+func (w *WS) shard(id uint) *connShard {
+	return w.shards[id%uint(len(w.shards))]
+}
+
+// conn returns the client of id.
+func (w *WS) conn(id uint) (*client, bool) {
+	s := w.shard(id)
+	s.mutex.RLock()
+	c, ok := s.conns[id]
+	s.mutex.RUnlock()
+	return c, ok
+}
+
+// lockID locks the shard of id to connect it, after w.mutex if the
+// ResumeTimeout session state, shared by all ids, changes with it.
+func (w *WS) lockID(id uint) (s *connShard, unlock func()) {
+	sessions := w.resumeTimeout > 0
+	if sessions {
+		w.mutex.Lock()
+	}
+	s = w.shard(id)
+	s.mutex.Lock()
+	return s, func() {
+		s.mutex.Unlock()
+		if sessions {
+			w.mutex.Unlock()
+		}
+	}
+}
+
+// lockClient locks the shard of the current id of c, which Rebind may
+// change until the lock is held.
+func (w *WS) lockClient(c *client) (s *connShard, id uint) {
+	for {
+		id = c.ID()
+		s = w.shard(id)
+		s.mutex.Lock()
+		if c.ID() == id {
+			return s, id
+		}
+		s.mutex.Unlock()
+	}
+}
+
+// lockShards locks the shards of a and b in shard order, once if they
+// share one.
+func (w *WS) lockShards(a, b uint) (sa, sb *connShard, unlock func()) {
+	n := uint(len(w.shards))
+	sa, sb = w.shard(a), w.shard(b)
+	first, second := sa, sb
+	if a%n > b%n {
+		first, second = sb, sa
+	}
+	first.mutex.Lock()
+	if second != first {
+		second.mutex.Lock()
+	}
+	return sa, sb, func() {
+		if second != first {
+			second.mutex.Unlock()
+		}
+		first.mutex.Unlock()
+	}
+}
+
+// clients returns a snapshot of all registered clients.
+func (w *WS) clients() []*client {
+	var clients []*client
+	for _, s := range w.shards {
+		s.mutex.RLock()
+		for _, c := range s.conns {
+			clients = append(clients, c)
+		}
+		s.mutex.RUnlock()
+	}
+	return clients
+}
+
+func (w *WS) connCount() (n int) {
+	for _, s := range w.shards {
+		s.mutex.RLock()
+		n += len(s.conns)
+		s.mutex.RUnlock()
+	}
+	return n
+}
+
+// OnlineIDs returns a snapshot of the ids with a connection, e.g. to
+// reconcile presence with an external store.
+func (w *WS) OnlineIDs() []uint {
+	ids := make([]uint, 0, w.connCount())
+	w.RangeOnline(func(id uint) bool {
+		ids = append(ids, id)
+		return true
+	})
+	return ids
+}
+
+// RangeOnline calls f for the ids with a connection until f returns false,
+// without allocating a slice of all of them. Ids are copied one shard at a
+// time and f is called without locks held, so it may use the WS; ids
+// connecting or disconnecting meanwhile may or may not be seen.
+func (w *WS) RangeOnline(f func(id uint) bool) {
+	var ids []uint
+	for _, s := range w.shards {
+		ids = ids[:0]
+		s.mutex.RLock()
+		for id := range s.conns {
+			ids = append(ids, id)
+		}
+		s.mutex.RUnlock()
+		for _, id := range ids {
+			if !f(id) {
+				return
+			}
+		}
+	}
+}
+
+// StaleConns returns the ids of connections without a pong for longer
+// than threshold, counting from the handshake until the first one. They
+// are likely half-open: the client is gone but no read has failed yet.
+func (w *WS) StaleConns(threshold time.Duration) []uint {
+	since := time.Now().Add(-threshold).UnixNano()
+	var ids []uint
+	for _, c := range w.clients() {
+		if atomic.LoadInt64(&c.lastPong) < since {
+			ids = append(ids, c.ID())
+		}
+	}
+	return ids
+}
+
+// Diagnostics returns the current connection and goroutine counts.
+func (w *WS) Diagnostics() Diagnostics {
+	return Diagnostics{
+		Conns:      w.connCount(),
+		Readers:    int(atomic.LoadInt64(&w.readers)),
+		Handlers:   int(atomic.LoadInt64(&w.handlers)),
+		Goroutines: runtime.NumGoroutine(),
+		Dropped:    int(atomic.LoadInt64(&w.dropped)),
+	}
+}
+
+// realClock is the default Clock.
+type realClock struct{}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+// rateLimiter counts messages in one second windows.
+type rateLimiter struct {
+	max   int
+	n     int
+	start time.Time
+}
+
+func (l *rateLimiter) allow(now time.Time) bool {
+	if now.Sub(l.start) >= time.Second {
+		l.start = now
+		l.n = 0
+	}
+	l.n++
+	return l.n <= l.max
+}
+
+// remaining returns the time left in the current window.
+func (l *rateLimiter) remaining(now time.Time) time.Duration {
+	return l.start.Add(time.Second).Sub(now)
+}
+
+// readMessage reads the next message from rw. With inf, messages with RSV1
+// set are inflated by it; otherwise any RSV bit fails the connection.
+// Messages over limit bytes, unless zero, fail with ErrMessageTooBig.
+func readMessage(rw io.ReadWriter, chMsg chan Message, inf *inflater, limit int) {
+	deflate := inf != nil
+	s := ws.StateServerSide
+	ch := wsutil.ControlFrameHandler(rw, s)
+
+	rd := wsutil.Reader{
+		Source:         rw,
+		State:          s,
+		CheckUTF8:      !deflate,
+		OnIntermediate: ch,
+	}
+	if deflate {
+		// Only RSV1 of the first frame is defined by permessage-deflate,
+		// and UTF-8 is checked after inflating.
+		rd.State |= ws.StateExtended
+		rd.OnContinuation = func(hdr ws.Header, r io.Reader) error {
+			if hdr.Rsv != 0 {
+				return ws.ErrProtocolNonZeroRsv
+			}
+			return nil
+		}
+	}
+
+	hdr, err := rd.NextFrame()
+	if err == nil && deflate && (hdr.Rsv2() || hdr.Rsv3() || hdr.Rsv1() && hdr.OpCode.IsControl()) {
+		err = ws.ErrProtocolNonZeroRsv
+	}
+	if err != nil {
+		chMsg <- Message{Err: err}
+		return
+	}
+	if hdr.OpCode.IsControl() {
+		if err := ch(hdr, &rd); err != nil {
+			chMsg <- Message{Err: err}
+			return
+		}
+		chMsg <- Message{Op: hdr.OpCode}
+		return
+	}
+
+	bts, err := readLimited(&rd, limit)
+	if err == nil && hdr.Rsv1() {
+		bts, err = inf.inflate(bts, limit)
+	}
+	if err == nil && deflate && hdr.OpCode == ws.OpText && !utf8.Valid(bts) {
+		err = wsutil.ErrInvalidUTF8
+	}
+
+	chMsg <- Message{
+		Body: bts,
+		Op:   hdr.OpCode,
+		Err:  err,
+	}
+	return
+}
+
+// deflateTail ends a permessage-deflate payload, which lacks the final
+// empty block, so that the flate reader returns io.EOF.
+const deflateTail = "\x00\x00\xff\xff\x01\x00\x00\xff\xff"
+
+// deflateWindow is the largest LZ77 window of permessage-deflate.
+const deflateWindow = 1 << 15
+
+// inflater inflates the permessage-deflate messages of a connection. The
+// client may keep its compression context between messages, the default,
+// so back references of a message can reach into the previous ones: the
+// last deflateWindow bytes inflated are the dictionary of the next.
+type inflater struct {
+	window []byte
+}
+
+// inflate decompresses a message of at most limit bytes, unless zero.
+func (f *inflater) inflate(p []byte, limit int) ([]byte, error) {
+	r := flate.NewReaderDict(io.MultiReader(bytes.NewReader(p), strings.NewReader(deflateTail)), f.window)
+	defer r.Close()
+	out, err := readLimited(r, limit)
+	if err == ErrMessageTooBig {
+		return nil, err
+	}
+	if err != nil {
+		return nil, ErrInflate
+	}
+	f.window = append(f.window, out...)
+	if len(f.window) > deflateWindow {
+		f.window = f.window[len(f.window)-deflateWindow:]
+	}
+	return out, nil
+}
+
+// readLimited reads r to the end, failing with ErrMessageTooBig after
+// limit bytes, unless zero.
+func readLimited(r io.Reader, limit int) ([]byte, error) {
+	if limit <= 0 {
+		return ioutil.ReadAll(r)
+	}
+	p, err := ioutil.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err == nil && len(p) > limit {
+		return nil, ErrMessageTooBig
+	}
+	return p, err
+}
+
+func (w *WS) WriteMessage(id uint, msg []byte) error {
+	return w.sendText(id, msg, false)
+}
+
+// WriteAcked is WriteMessage for messages the client acknowledges: each
+// takes a slot of the MaxInFlight window of id until Ack frees it. The
+// message isn't kept with OfflineBuffer.
+func (w *WS) WriteAcked(id uint, msg []byte) error {
+	return w.sendText(id, msg, true)
+}
+
+// sendText writes msg to id, in a MaxInFlight slot if acked.
+func (w *WS) sendText(id uint, msg []byte, acked bool) error {
+	if w.onSendWrapper(id, msg) {
+		// The map isn't locked during the write, which may wait for a
+		// WriteStream to id.
+		conn, ok := w.conn(id)
+		if !ok {
+			if !acked && w.queue(id, msg) {
+				return nil
+			}
+			// id has connected since.
+			if conn, ok = w.conn(id); !ok {
+				w.l.Printf("Connection not found for device: %d\n", id)
+				return ErrConnNotFound
+			}
+		}
+		err := w.writeText(id, conn, msg, acked)
+		if err != nil {
+			// A reconnect of id may have replaced conn during the write.
+			if cur, ok := w.conn(id); ok && cur != conn {
+				err = w.writeText(id, cur, msg, acked)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// writeText writes msg to conn of id, or batches it with CoalesceWindow.
+// An acked msg takes a MaxInFlight slot.
+func (w *WS) writeText(id uint, conn *client, msg []byte, acked bool) error {
+	if acked && !w.reserveInFlight(conn) {
+		return ErrWindowFull
+	}
+	if conn.batch != nil {
+		w.enqueue(conn, msg, acked)
+		return nil
+	}
+	start := time.Now()
+	err := w.writeFrame(conn, ws.OpText, msg)
+	w.observeSince(ObserveWrite, start)
+	if err != nil && acked && w.maxInFlight > 0 {
+		// A failed message won't be acked.
+		releaseInFlight(conn, 1)
+	}
+	if isDeadConnError(err) {
+		// The read loop of conn sees the close and runs the offline
+		// cleanup for id.
+		conn.Close()
+		return ErrConnClosed
+	}
+	if err != nil {
+		w.l.Printf("[%s] Write error: %s\n", conn.logID(), err)
+	}
+	return err
+}
+
+// reserveInFlight takes a slot of the MaxInFlight window of c and reports
+// whether one was free.
+func (w *WS) reserveInFlight(c *client) bool {
+	if w.maxInFlight <= 0 {
+		return true
+	}
+	for {
+		n := atomic.LoadInt32(&c.inFlight)
+		if n >= w.maxInFlight {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&c.inFlight, n, n+1) {
+			return true
+		}
+	}
+}
+
+// Ack acknowledges n messages written to id with WriteAcked, freeing as
+// many slots of its MaxInFlight window. Acks beyond the unacked messages are ignored.
+func (w *WS) Ack(id uint, n int) error {
+	c, ok := w.conn(id)
+	if !ok {
+		return ErrConnNotFound
+	}
+	releaseInFlight(c, n)
+	return nil
+}
+
+func releaseInFlight(c *client, n int) {
+	for {
+		cur := atomic.LoadInt32(&c.inFlight)
+		next := cur - int32(n)
+		if next < 0 {
+			next = 0
+		}
+		if atomic.CompareAndSwapInt32(&c.inFlight, cur, next) {
+			return
+		}
+	}
+}
+
+// SendCodec encodes v with Config.Codec and writes it with WriteMessage.
+func (w *WS) SendCodec(id uint, v interface{}) error {
+	msg, err := w.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return w.WriteMessage(id, msg)
+}
+
+type replyKey struct{}
+
+type replier struct {
+	w *WS
+	c *client
+}
+
+// Reply writes msg like WriteMessage to the connection that sent the
+// message ctx was passed to OnTextContext with. Once that connection is
+// closed, e.g. replaced by a reconnect of its id, it returns ErrConnClosed
+// rather than writing to the new one. It returns ErrNoReply for other
+// contexts.
+func Reply(ctx context.Context, msg []byte) error {
+	r, ok := ctx.Value(replyKey{}).(replier)
+	if !ok {
+		return ErrNoReply
+	}
+	id := r.c.ID()
+	if !r.w.onSendWrapper(id, msg) {
+		return nil
+	}
+	return r.w.writeText(id, r.c, msg, false)
+}
+
+// ConnID returns the ConnID of the connection that sent the message ctx
+// was passed to OnTextContext with, or "" for other contexts.
+func ConnID(ctx context.Context) string {
+	r, ok := ctx.Value(replyKey{}).(replier)
+	if !ok {
+		return ""
+	}
+	return r.c.connID
+}
+
+// Ban refuses connections of id until then: once authenticated they are
+// closed with 1008 (policy violation). A current connection of id is left
+// open.
+func (w *WS) Ban(id uint, until time.Time) {
+	s := w.shard(id)
+	s.mutex.Lock()
+	s.bans[id] = until
+	s.mutex.Unlock()
+}
+
+// Unban lifts the ban of id.
+func (w *WS) Unban(id uint) {
+	s := w.shard(id)
+	s.mutex.Lock()
+	delete(s.bans, id)
+	s.mutex.Unlock()
+}
+
+// banned reports whether id is banned, forgetting an expired ban. The
+// mutex of s, the shard of id, must be held.
+func (w *WS) banned(s *connShard, id uint) bool {
+	until, ok := s.bans[id]
+	if ok && !time.Now().Before(until) {
+		delete(s.bans, id)
+		return false
+	}
+	return ok
+}
+
+// queue keeps msg for id with OfflineBuffer. It returns false if that is
+// disabled or id is connected.
+func (w *WS) queue(id uint, msg []byte) bool {
+	if w.offlineBuffer <= 0 {
+		return false
+	}
+	s := w.shard(id)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.conns[id]; ok {
+		return false
+	}
+	q := s.queued[id]
+	if len(q) == 0 && w.offlineTTL > 0 {
+		time.AfterFunc(w.offlineTTL, func() {
+			w.expireQueued(id)
+		})
+	}
+	q = append(q, queued{msg: append([]byte(nil), msg...), at: time.Now()})
+	if len(q) > w.offlineBuffer {
+		q = q[len(q)-w.offlineBuffer:]
+	}
+	s.queued[id] = q
+	return true
+}
+
+// expireQueued drops the messages of id older than OfflineTTL and checks
+// again once the oldest remaining one expires.
+func (w *WS) expireQueued(id uint) {
+	s := w.shard(id)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	q := s.queued[id]
+	for len(q) > 0 && time.Since(q[0].at) >= w.offlineTTL {
+		q = q[1:]
+	}
+	if len(q) == 0 {
+		delete(s.queued, id)
+		return
+	}
+	s.queued[id] = q
+	time.AfterFunc(w.offlineTTL-time.Since(q[0].at), func() {
+		w.expireQueued(id)
+	})
+}
+
+// takeQueued removes and returns the unexpired messages kept for id. The
+// mutex of s, the shard of id, must be held.
+func (w *WS) takeQueued(s *connShard, id uint) []queued {
+	q := s.queued[id]
+	delete(s.queued, id)
+	for len(q) > 0 && w.offlineTTL > 0 && time.Since(q[0].at) >= w.offlineTTL {
+		q = q[1:]
+	}
+	return q
+}
+
+func (w *WS) writeQueued(c *client, q []queued) {
+	for _, m := range q {
+		if err := w.writeText(c.ID(), c, m.msg, false); err != nil {
+			return
+		}
+	}
+}
+
+// WriteControl writes a ping, pong or close frame with payload to id, e.g.
+// for a custom heartbeat. A close payload is built with
+// ws.NewCloseFrameBody; the connection is closed once the client answers
+// it. Payloads over 125 bytes are refused with ErrControlSize.
+func (w *WS) WriteControl(id uint, op ws.OpCode, payload []byte) error {
+	if !op.IsControl() {
+		return ErrNotControl
+	}
+	if len(payload) > ws.MaxControlFramePayloadSize {
+		return ErrControlSize
+	}
+	c, ok := w.conn(id)
+	if !ok {
+		w.l.Printf("Connection not found for device: %d\n", id)
+		return ErrConnNotFound
+	}
+	err := w.writeFrame(c, op, payload)
+	if isDeadConnError(err) {
+		c.Close()
+		return ErrConnClosed
+	}
+	return err
+}
+
+// WriteStream writes r to id as one message of op, fragmented into frames
+// as r is read, so large payloads needn't be held in memory. Other messages
+// to id wait until the stream is written, while control frames can go out
+// between its frames. A failed stream leaves a partial message, so the
+// connection is closed. OnSend is not called.
+func (w *WS) WriteStream(id uint, op ws.OpCode, r io.Reader) error {
+	c, ok := w.conn(id)
+	if !ok {
+		w.l.Printf("Connection not found for device: %d\n", id)
+		return ErrConnNotFound
+	}
+	if c.batch != nil {
+		w.flush(c)
+	}
+
+	c.mmu.Lock()
+	defer c.mmu.Unlock()
+	w.sent.add(op)
+	start := time.Now()
+	end := w.span(SpanWrite, AttrID, id, AttrOpCode, int(op))
+	sw := w.newWriter(lockedWriter{c}, op)
+	_, err := sw.ReadFrom(r)
+	if err == nil {
+		err = sw.Flush()
+	}
+	end(err)
+	w.observeSince(ObserveWrite, start)
+	w.wrote(c, err)
+	if isDeadConnError(err) {
+		c.Close()
+		return ErrConnClosed
+	}
+	if err != nil {
+		w.l.Printf("[%s] Stream error: %s\n", c.logID(), err)
+		w.closeConn(c, ws.StatusInternalServerError, "")
+	}
+	return err
+}
+
+// Rebind moves the connection of oldID to newID, e.g. once a temporary id
+// logs in, and calls OnRebind. Its resume token, if any, is invalidated.
+// newID must not be zero nor banned.
+func (w *WS) Rebind(oldID, newID uint) error {
+	if newID == 0 {
+		return ErrZeroID
+	}
+	w.mutex.Lock()
+	from, to, unlock := w.lockShards(oldID, newID)
+	c, ok := from.conns[oldID]
+	if !ok {
+		unlock()
+		w.mutex.Unlock()
+		return ErrConnNotFound
+	}
+	if _, ok := to.conns[newID]; ok {
+		unlock()
+		w.mutex.Unlock()
+		return ErrIDInUse
+	}
+	if w.banned(to, newID) {
+		unlock()
+		w.mutex.Unlock()
+		return ErrIDBanned
+	}
+	delete(from.conns, oldID)
+	to.conns[newID] = c
+	if from.last[oldID] == c {
+		delete(from.last, oldID)
+		to.last[newID] = c
+	}
+	// Set with both shards locked for lockClient.
+	atomic.StoreUint64(&c.id, uint64(newID))
+	unlock()
+	if s, ok := w.sessions[oldID]; ok && s.offline == nil {
+		delete(w.sessions, oldID)
+		delete(w.resumes, s.token)
+	}
+	w.mutex.Unlock()
+
+	w.onRebindWrapper(oldID, newID)
+	return nil
+}
+
+// RawConn returns the underlying net.Conn of id, e.g. to read TLS state.
+// Writing to it directly bypasses OnSend, write batching and the framing
+// of the server, and may corrupt the WebSocket stream.
+func (w *WS) RawConn(id uint) (net.Conn, bool) {
+	if c, ok := w.conn(id); ok {
+		return c.Conn, true
+	}
+	return nil, false
+}
+
+// QueueDepth returns how many messages written to id wait in the
+// CoalesceWindow batch, always 0 without one. ok is false if id isn't
+// connected.
+func (w *WS) QueueDepth(id uint) (depth int, ok bool) {
+	c, ok := w.conn(id)
+	if !ok || c.batch == nil {
+		return 0, ok
+	}
+	c.batch.mutex.Lock()
+	defer c.batch.mutex.Unlock()
+	return len(c.batch.msgs), true
+}
+
+// Flush writes the messages waiting in the CoalesceWindow batch of id
+// now, e.g. before a priority message or closing the connection. It is a
+// no-op without CoalesceWindow.
+func (w *WS) Flush(id uint) error {
+	c, ok := w.conn(id)
+	if !ok {
+		return ErrConnNotFound
+	}
+	if c.batch == nil {
+		return nil
+	}
+	return w.flush(c)
+}
+
+// ConnInfo describes the connection of id.
+func (w *WS) ConnInfo(id uint) (ConnInfo, error) {
+	c, ok := w.conn(id)
+	if !ok {
+		return ConnInfo{}, ErrConnNotFound
+	}
+	return c.info(), nil
+}
+
+func (c *client) info() ConnInfo {
+	return ConnInfo{
+		ID:         c.ID(),
+		RemoteAddr: addrString(c.RemoteAddr()),
+		Request:    c.req,
+		Protocol:   c.protocol,
+		Extensions: c.extensions,
+		Connected:  c.connected,
+		ConnID:     c.connID,
+		LastRTT:    time.Duration(atomic.LoadInt64(&c.rtt)),
+	}
+}
+
+// CompressionEnabled reports whether permessage-deflate was negotiated for
+// id. The package doesn't compress itself, so this is only the case if
+// Upgrader accepts the extension; compressed messages from the client are
+// then inflated and outbound frames are sent uncompressed. Clients may
+// keep their compression context between messages or not, so neither
+// client_no_context_takeover nor client_max_window_bits need to be
+// negotiated. Inflated messages are bounded by MaxMessageSize.
+func (w *WS) CompressionEnabled(id uint) bool {
+	c, ok := w.conn(id)
+	return ok && c.deflate()
+}
+
+// Write counts the bytes written to c for WriteRetries.
+func (c *client) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+// logID prefixes the log lines of c with its id and ConnID.
+func (c *client) logID() string {
+	return fmt.Sprintf("%d %s", c.ID(), c.connID)
+}
+
+// deflate reports whether permessage-deflate was negotiated for c.
+func (c *client) deflate() bool {
+	for _, name := range c.extensions {
+		if name == ExtensionDeflate {
+			return true
+		}
+	}
+	return false
+}
+
+// Request returns the handshake request of the connection of id. It is
+// available from OnOnline on.
+func (w *WS) Request(id uint) (Request, error) {
+	c, ok := w.conn(id)
+	if !ok {
+		return Request{}, ErrConnNotFound
+	}
+	return c.req, nil
+}
+
+// State returns the state of the connection of id.
+func (w *WS) State(id uint) (ConnState, error) {
+	c, ok := w.conn(id)
+	if !ok {
+		return 0, ErrConnNotFound
+	}
+	return ConnState(atomic.LoadInt32(&c.state)), nil
+}
+
+// SetState moves the connection of id to state.
+func (w *WS) SetState(id uint, state ConnState) error {
+	c, ok := w.conn(id)
+	if !ok {
+		return ErrConnNotFound
+	}
+	atomic.StoreInt32(&c.state, int32(state))
+	return nil
+}
+
+// Pause stops reading from the connection of id once the frame being read,
+// if any, is received, applying TCP backpressure to the client. Pings are
+// suspended while paused.
+func (w *WS) Pause(id uint) error {
+	return w.setPaused(id, true)
+}
+
+// Resume restarts reading from the connection of id after Pause.
+func (w *WS) Resume(id uint) error {
+	return w.setPaused(id, false)
+}
+
+func (w *WS) setPaused(id uint, paused bool) error {
+	c, ok := w.conn(id)
+	if !ok {
+		return ErrConnNotFound
+	}
+	var v int32
+	if paused {
+		v = 1
+	}
+	atomic.StoreInt32(&c.paused, v)
+	select {
+	case c.flow <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// ID returns the id of c, which Rebind may change.
+func (c *client) ID() uint {
+	return uint(atomic.LoadUint64(&c.id))
+}
+
+func (c *client) isPaused() bool {
+	return atomic.LoadInt32(&c.paused) == 1
+}
+
+// enqueue adds msg to the batch of c, scheduling its flush on the first
+// message of the batch.
+func (w *WS) enqueue(c *client, msg []byte, acked bool) {
+	b := c.batch
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.msgs = append(b.msgs, append([]byte(nil), msg...))
+	if acked {
+		b.acked++
+	}
+	if len(b.msgs) == 1 {
+		time.AfterFunc(w.coalesceWindow, func() {
+			w.flush(c)
+		})
+	}
+}
+
+func (w *WS) flush(c *client) error {
+	b := c.batch
+	b.mutex.Lock()
+	if len(b.msgs) == 0 {
+		b.mutex.Unlock()
+		return nil
+	}
+	msgs, acked := b.msgs, b.acked
+	start := time.Now()
+	err := w.writeFrame(c, ws.OpText, bytes.Join(msgs, []byte{'\n'}))
+	w.observeSince(ObserveWrite, start)
+	b.msgs, b.acked = nil, 0
+	b.mutex.Unlock()
+
+	if isDeadConnError(err) {
+		c.Close()
+	} else if err != nil {
+		w.l.Printf("[%s] Write error: %s\n", c.logID(), err)
+	}
+	if err != nil {
+		if w.maxInFlight > 0 {
+			// The dropped messages won't be acked.
+			releaseInFlight(c, acked)
+		}
+		for _, msg := range msgs {
+			w.onDropWrapper(c.ID(), msg)
+		}
+	}
+	if isDeadConnError(err) {
+		return ErrConnClosed
+	}
+	return err
+}
+
+func (w *WS) CloseConnection(id uint) error {
+	if conn, ok := w.conn(id); ok {
+		return w.closeConn(conn, ws.StatusProtocolError, "")
+	}
+	w.l.Printf("Connection not found for device: %d\n", id)
+	return ErrConnNotFound
+}
+
+// CloseConnectionAndWait closes the connection of id like CloseConnection
+// and waits for its read loop to exit and OnOffline to return. If ctx ends
+// first, ctx.Err() is returned; OnOffline still runs. With ResumeTimeout
+// OnOffline is deferred until the session expires, so it doesn't return
+// before that, nor at all if the id resumes it.
+func (w *WS) CloseConnectionAndWait(ctx context.Context, id uint) error {
+	conn, ok := w.conn(id)
+	if !ok {
+		w.l.Printf("Connection not found for device: %d\n", id)
+		return ErrConnNotFound
+	}
+	if err := w.closeConn(conn, ws.StatusProtocolError, ""); err != nil && !isClosedConnError(err) {
+		return err
+	}
+	select {
+	case <-conn.offlineDone:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SendAndClose writes msg to id and then closes the connection with code
+// and reason. Both are written while holding the message lock of the
+// connection, so no other WriteMessage can slip in between.
+func (w *WS) SendAndClose(id uint, msg []byte, code ws.StatusCode, reason string) error {
+	send := w.onSendWrapper(id, msg)
+	conn, ok := w.conn(id)
+	if !ok {
+		w.l.Printf("Connection not found for device: %d\n", id)
+		return ErrConnNotFound
+	}
+	if conn.batch != nil {
+		w.flush(conn)
+	}
+	conn.mmu.Lock()
+	defer conn.mmu.Unlock()
+	if send {
+		w.sent.add(ws.OpText)
+		w.logPayload(conn, "Sending", msg)
+		err := w.writeMessage(conn, ws.OpText, msg)
+		w.wrote(conn, err)
+		if err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	return w.closeConn(conn, code, reason)
+}
+
+// Broadcast writes msg to every connection with WriteMessage, using up to
+// BroadcastWorkers concurrent writers over a snapshot of the connections.
+// It returns how many writes succeeded and failed; messages dropped by
+// OnSend count as sent.
+func (w *WS) Broadcast(msg []byte) (sent, failed int) {
+	return w.BroadcastWhere(nil, msg)
+}
+
+// BroadcastWhereProtocol broadcasts msg like Broadcast, but only to the
+// connections that negotiated protocol, e.g. new message formats during a
+// client rollout.
+func (w *WS) BroadcastWhereProtocol(protocol string, msg []byte) (sent, failed int) {
+	return w.BroadcastWhere(func(info ConnInfo) bool {
+		return info.Protocol == protocol
+	}, msg)
+}
+
+// BroadcastWhere broadcasts msg like Broadcast, but only to the
+// connections whose ConnInfo matches pred. A nil pred matches all.
+func (w *WS) BroadcastWhere(pred func(info ConnInfo) bool, msg []byte) (sent, failed int) {
+	var ids []uint
+	for _, c := range w.clients() {
+		if pred == nil || pred(c.info()) {
+			ids = append(ids, c.ID())
+		}
+	}
+
+	var ok, fail int64
+	jobs := make(chan uint)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < w.broadcasters && i < len(ids); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range jobs {
+				if w.WriteMessage(id, msg) == nil {
+					atomic.AddInt64(&ok, 1)
+				} else {
+					atomic.AddInt64(&fail, 1)
+				}
+			}
+		}()
+	}
+	for _, id := range ids {
+		jobs <- id
+	}
+	close(jobs)
+	wg.Wait()
+	return int(ok), int(fail)
+}
+
+// CloseAll closes every connection with the close code and reason returned
+// by closeFrame for its id, e.g. to send cohort-specific codes on deploys.
+func (w *WS) CloseAll(closeFrame func(id uint) (code ws.StatusCode, reason string)) {
+	for _, conn := range w.clients() {
+		id := conn.ID()
+		code, reason := closeFrame(id)
+		if err := w.closeConn(conn, code, reason); err != nil && !isClosedConnError(err) {
+			w.l.Printf("[%s] Close connection err: %s\n", conn.logID(), err)
+		}
+	}
+}
+
+// CloseWhere closes the connections whose ConnInfo matches pred with code
+// and reason, e.g. those of an IP range during an incident, and returns
+// how many it closed.
+func (w *WS) CloseWhere(pred func(info ConnInfo) bool, code ws.StatusCode, reason string) (closed int) {
+	for _, conn := range w.clients() {
+		if !pred(conn.info()) {
+			continue
+		}
+		if err := w.closeConn(conn, code, reason); err != nil && !isClosedConnError(err) {
+			w.l.Printf("[%s] Close connection err: %s\n", conn.logID(), err)
+		}
+		closed++
+	}
+	return closed
+}
+
+// Shutdown stops the server in order: it stops accepting connections and
+// pinging, closes every connection with a 1001 close frame and waits for
+// their read loops to exit and OnOffline to return, then fires OnOffline of
+// suspended sessions. The connections are closed concurrently and a close
+// frame a client doesn't read is given up after TimeoutClose. If ctx ends
+// first, the remaining connections are closed without waiting for them and
+// ctx.Err() is returned; their OnOffline still runs. The OnTextWorkers
+// are stopped once the read loops have exited and waited for like the
+// connections. The health probe answers 503 meanwhile and is closed last.
+func (w *WS) Shutdown(ctx context.Context) error {
+	w.mutex.Lock()
+	atomic.StoreInt32(&w.closed, 1)
+	w.setAcceptErr(ErrServerClosed)
+	ln := w.ln
+	w.ln = nil
+	clients := w.clients()
+	var suspended []*client
+	for id, s := range w.sessions {
+		if s.offline != nil && s.offline.Stop() {
+			s.offline = nil
+			delete(w.sessions, id)
+			delete(w.resumes, s.token)
+			suspended = append(suspended, s.client)
+		}
+	}
+	w.mutex.Unlock()
+
+	if ln != nil {
+		if err := ln.Close(); err != nil {
+			w.l.Printf("Close listener error: %s", err)
+		}
+	}
+	for _, c := range clients {
+		go func(c *client) {
+			if err := w.closeConn(c, ws.StatusGoingAway, "Server shutdown"); err != nil && !isClosedConnError(err) {
+				w.l.Printf("[%s] Close connection err: %s\n", c.logID(), err)
+			}
+		}(c)
+	}
+	var err error
+Wait:
+	for i, c := range clients {
+		select {
+		case <-c.offlineDone:
+		case <-ctx.Done():
+			for _, c := range clients[i:] {
+				c.Close()
+			}
+			err = ctx.Err()
+			break Wait
+		}
+	}
+	if w.texts != nil {
+		stopped := make(chan struct{})
+		go func() {
+			w.stopWorkers()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	for _, c := range suspended {
+		w.onOfflineWrapper(c.ID(), c.reason)
+		w.offlineDone(c)
+	}
+	if w.hln != nil {
+		if err := w.hln.Close(); err != nil {
+			w.l.Printf("Close health probe error: %s", err)
+		}
+	}
+	return err
+}
+
+// dispatchText hands t to the OnTextWorkers. It is dropped once Shutdown
+// has stopped them.
+func (w *WS) dispatchText(t text) {
+	w.textsMu.RLock()
+	defer w.textsMu.RUnlock()
+	if !w.textsClosed {
+		w.texts <- t
+	}
+}
+
+// stopWorkers closes texts and waits for the OnTextWorkers to return.
+func (w *WS) stopWorkers() {
+	w.textsMu.Lock()
+	if !w.textsClosed {
+		w.textsClosed = true
+		close(w.texts)
+	}
+	w.textsMu.Unlock()
+	w.workers.Wait()
+}
+
+func (w *WS) isClosed() bool {
+	return atomic.LoadInt32(&w.closed) == 1
+}
+
+// Drain quiesces the server ahead of Shutdown: new connections are rejected
+// with 503 before OnAuth and inbound text messages are discarded,
+// while existing connections stay open, are pinged and can still be
+// written to so in-flight responses complete. OnText calls already
+// dispatched run to completion.
+func (w *WS) Drain() {
+	atomic.StoreInt32(&w.draining, 1)
+}
+
+func (w *WS) isDraining() bool {
+	return atomic.LoadInt32(&w.draining) == 1
+}
+
+// authCredential returns the credential of an Authorization header value
+// using one of the accepted schemes.
+func (w *WS) authCredential(v string) (token string, ok bool) {
+	for _, scheme := range w.authSchemes {
+		if strings.HasPrefix(v, scheme+" ") {
+			return v[len(scheme)+1:], true
+		}
+	}
+	return "", false
+}
+
+// resumeID returns the id of the session issued token.
+func (w *WS) resumeID(token string) (id uint, ok bool) {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	id, ok = w.resumes[token]
+	return
+}
+
+// resumeSession binds token to the session of id and reports whether a
+// suspended session was resumed. w.mutex must be held.
+func (w *WS) resumeSession(id uint, token string) (resumed bool) {
+	if w.resumeTimeout <= 0 {
+		return false
+	}
+	s, ok := w.sessions[id]
+	if ok {
+		delete(w.resumes, s.token)
+		if s.offline != nil && s.offline.Stop() {
+			s.offline = nil
+			resumed = true
+		}
+	}
+	if !resumed {
+		// A session whose timer has already fired is left to it, so
+		// OnOffline still fires for it.
+		s = &session{}
+		w.sessions[id] = s
+	}
+	s.token = token
+	if token != "" {
+		w.resumes[token] = id
+	}
+	return
+}
+
+// suspendSession fires OnOffline for c unless its id reconnects within
+// resumeTimeout. Once Shutdown started it reports false and the caller
+// fires OnOffline at once.
+func (w *WS) suspendSession(c *client) bool {
+	id := c.ID()
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.isClosed() {
+		return false
+	}
+	s, ok := w.sessions[id]
+	if !ok {
+		s = &session{}
+		w.sessions[id] = s
+	}
+	var t *time.Timer
+	t = time.AfterFunc(w.resumeTimeout, func() {
+		w.mutex.Lock()
+		if s.offline != t {
+			w.mutex.Unlock()
+			return
+		}
+		s.offline = nil
+		if w.sessions[id] == s {
+			delete(w.sessions, id)
+			delete(w.resumes, s.token)
+		}
+		w.mutex.Unlock()
+
+		w.onOfflineWrapper(id, c.reason)
+		w.offlineDone(c)
+	})
+	s.offline = t
+	s.client = c
+	return true
+}
+
+// offlineDone marks OnOffline of c as returned.
+func (w *WS) offlineDone(c *client) {
+	close(c.offlineDone)
+	s, id := w.lockClient(c)
+	if s.last[id] == c {
+		delete(s.last, id)
+	}
+	s.mutex.Unlock()
+}
+
+// writeFrame writes a single frame of op to c and counts it in Stats.
+func (w *WS) writeFrame(c *client, op ws.OpCode, p []byte) error {
+	if !op.IsControl() {
+		c.mmu.Lock()
+		defer c.mmu.Unlock()
+	}
+	w.sent.add(op)
+	if !op.IsControl() {
+		w.logPayload(c, "Sending", p)
+	}
+	before := atomic.LoadInt64(&c.written)
+	err := w.writeMessage(c, op, p)
+	for i, delay := 0, WriteRetryBackoff; i < w.writeRetries && isTemporary(err); i++ {
+		if atomic.LoadInt64(&c.written) != before {
+			// Part of p was sent, a retry would corrupt the stream.
+			break
+		}
+		time.Sleep(delay)
+		delay *= 2
+		err = w.writeMessage(c, op, p)
+	}
+	w.wrote(c, err)
+	return err
+}
+
+// writeMessage writes p to c, fragmented by MaxFrameSize unless op is a
+// control frame. c.mmu must be held for data frames. Each frame is written
+// under c.wmu, so control frames can go out between fragments.
+func (w *WS) writeMessage(c *client, op ws.OpCode, p []byte) (err error) {
+	if !op.IsControl() {
+		end := w.span(SpanWrite, AttrID, c.ID(), AttrOpCode, int(op), AttrBytes, len(p))
+		defer func() { end(err) }()
+	}
+	if w.maxFrameSize <= 0 || len(p) <= w.maxFrameSize || op.IsControl() {
+		c.wmu.Lock()
+		defer c.wmu.Unlock()
+		return wsutil.WriteServerMessage(c, op, p)
+	}
+	// Write would send p in a single frame, ReadFrom fills frames of
+	// the buffer size and writes each in a single Write.
+	sw := w.newWriter(lockedWriter{c}, op)
+	if _, err := sw.ReadFrom(bytes.NewReader(p)); err != nil {
+		return err
+	}
+	return sw.Flush()
+}
+
+func (w *WS) newWriter(dst io.Writer, op ws.OpCode) *wsutil.Writer {
+	if w.maxFrameSize > 0 {
+		return wsutil.NewWriterSize(dst, ws.StateServerSide, op, w.maxFrameSize)
+	}
+	return wsutil.NewWriter(dst, ws.StateServerSide, op)
+}
+
+// wrote records the result of a write to c. A failure is reported to
+// OnWriteError and c is closed after MaxWriteErrors failures in a row.
+func (w *WS) wrote(c *client, err error) {
+	if err == nil {
+		atomic.StoreInt32(&c.writeErrs, 0)
+		return
+	}
+	w.emit(Event{Type: EventError, ID: c.ID(), Err: err})
+	if w.onWriteError != nil {
+		go w.onWriteErrorWrapper(c.ID(), err)
+	}
+	n := atomic.AddInt32(&c.writeErrs, 1)
+	if w.maxWriteErrors > 0 && int(n) == w.maxWriteErrors {
+		w.l.Printf("[%s] %d write errors in a row, closing\n", c.logID(), n)
+		atomic.StoreInt32(&c.evicted, 1)
+		c.Close()
+	}
+}
+
+// Events returns the lifecycle event stream, or nil unless EventBuffer is
+// set. Handlers are still called; Events is an alternative way to observe
+// them, e.g. for an event log.
+func (w *WS) Events() <-chan Event {
+	return w.events
+}
+
+func (w *WS) emit(e Event) {
+	if w.events == nil {
+		return
+	}
+	select {
+	case w.events <- e:
+	default:
+		atomic.AddInt64(&w.dropped, 1)
+	}
+}
+
+// closeConn is CloseConn counting the close frame in Stats. The frame is
+// written under the frame lock of c so it can't interleave with another
+// one; a write blocked on a client that stopped reading fails after
+// TimeoutClose instead of holding the lock forever.
+func (w *WS) closeConn(c *client, code ws.StatusCode, reason string) error {
+	c.SetWriteDeadline(time.Now().Add(TimeoutClose))
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	w.sent.add(ws.OpClose)
+	return CloseConn(c, code, reason)
+}
+
+// Stats returns the frame counts by opcode.
+func (w *WS) Stats() Stats {
+	return Stats{
+		Received: w.received.counts(),
+		Sent:     w.sent.counts(),
+
+		OpenConns:   atomic.LoadInt64(&w.open),
+		AcceptWaits: atomic.LoadInt64(&w.waits),
+
+		Handshakes: w.hsStats.stats(),
+	}
+}
+
+func (hc *handshakeCounters) add(d time.Duration) {
+	atomic.AddInt64(&hc.count, 1)
+	atomic.AddInt64(&hc.total, int64(d))
+	i := 0
+	for i < len(handshakeBuckets) && d > handshakeBuckets[i] {
+		i++
+	}
+	atomic.AddInt64(&hc.buckets[i], 1)
+}
+
+func (hc *handshakeCounters) stats() (st HandshakeStats) {
+	st.Count = atomic.LoadInt64(&hc.count)
+	st.Total = time.Duration(atomic.LoadInt64(&hc.total))
+	for i := range st.Buckets {
+		st.Buckets[i] = atomic.LoadInt64(&hc.buckets[i])
+	}
+	return st
+}
+
+func (fc *frameCounters) add(op ws.OpCode) {
+	atomic.AddInt64(&fc[op&0xf], 1)
+}
+
+func (fc *frameCounters) counts() FrameCounts {
+	return FrameCounts{
+		Text:   atomic.LoadInt64(&fc[ws.OpText]),
+		Binary: atomic.LoadInt64(&fc[ws.OpBinary]),
+		Ping:   atomic.LoadInt64(&fc[ws.OpPing]),
+		Pong:   atomic.LoadInt64(&fc[ws.OpPong]),
+		Close:  atomic.LoadInt64(&fc[ws.OpClose]),
+	}
+}
+
+// CloseConn sends a close frame with code and reason to conn and closes it.
+// A failed close frame write does not prevent closing conn.
+func CloseConn(conn net.Conn, code ws.StatusCode, reason string) error {
+	wsutil.WriteServerMessage(conn, ws.OpClose, ws.NewCloseFrameBody(code, reason))
+	return conn.Close()
+}
+
+// onPanic applies the PanicPolicy after a hook called for the connection c
+// panicked and reports whether the action guarded by the hook should go
+// ahead. c is nil before authentication. c itself is closed, not the
+// connection its id has by then, which may have reconnected.
+func (w *WS) onPanic(c *client) (proceed bool) {
+	switch w.panicPolicy {
+	case PanicFailOpen:
+		return true
+	case PanicCloseConn:
+		if c != nil {
+			go w.closeConn(c, ws.StatusProtocolError, "")
+		}
+	}
+	return false
+}
+
+func (w *WS) onAcceptWrapper(conn net.Conn) (allow bool) {
+	if w.onAccept == nil {
+		return true
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			allow = w.onPanic(nil)
+			w.l.Printf("[Recovery OnAccept] panic recovered:\n%s\n\n", r)
+		}
+	}()
+	return w.onAccept(conn)
+}
+
+func (w *WS) onAuthRejectWrapper(remoteAddr string, reason error) {
+	if w.onAuthReject == nil {
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			w.l.Printf("[Recovery OnAuthReject] panic recovered:\n%s\n\n", r)
+		}
+	}()
+	w.onAuthReject(remoteAddr, reason)
+}
+
+func (w *WS) onDropWrapper(id uint, msg []byte) {
+	if w.onDrop == nil {
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			w.l.Printf("[Recovery OnDrop] panic recovered:\n%s\n\n", r)
 		}
 	}()
-
-	cfg.Handlers.SetConnCtrlr(&w)
-	return &w, nil
+	w.onDrop(id, msg)
 }
 
-func (w *WS) handle(conn net.Conn) {
-	defer conn.Close()
-	var id uint
+func (w *WS) onWriteErrorWrapper(id uint, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			w.l.Printf("[Recovery OnWriteError] panic recovered:\n%s\n\n", r)
+		}
+	}()
+	w.onWriteError(id, err)
+}
 
-	u := ws.Upgrader{
-		OnRequest: func(uri []byte) error {
-			if u, err := url.Parse(string(uri)); err == nil && u.RawQuery != "" {
-				if m, e := url.ParseQuery(u.RawQuery); e == nil {
-					if token, ok := m[AuthTokenKey]; ok {
-						if id, ok = w.onAuthWrapper(token[0]); !ok {
-							return ErrAuthFailed
-						}
-					}
-				}
-			}
-			return nil
-		},
-		OnHeader: func(key, value []byte) error {
-			if id == 0 && string(key) == "Authorization" {
-				v := string(value)
-				switch {
-				case strings.HasPrefix(v, "Bearer "), strings.HasPrefix(v, "Basic "):
-					var ok bool
-					if id, ok = w.onAuthWrapper(strings.SplitN(v, " ", 2)[1]); !ok {
-						return ErrAuthFailed
-					}
-				default:
-					return ErrBadAuthHeader
-				}
-			}
-			return nil
-		},
-		OnBeforeUpgrade: func() (header ws.HandshakeHeader, err error) {
-			if id == 0 {
-				return nil, ErrNotAuth
-			}
-			return
-		},
+func (w *WS) onReconnectWrapper(id uint) {
+	h, ok := w.h.(ReconnectHandlers)
+	if !ok {
+		return
 	}
-	if _, err := u.Upgrade(conn); err == nil {
-		w.mutex.Lock()
-		if existConn, ok := w.conns[id]; ok {
-			if existConn != conn {
-				err := existConn.Close()
-				if err != nil {
-					w.l.Print("Close connection err:", err)
-				}
-			}
+	defer func() {
+		if r := recover(); r != nil {
+			w.l.Printf("[Recovery OnReconnect] panic recovered:\n%s\n\n", r)
 		}
-		w.conns[id] = conn
-		w.mutex.Unlock()
-
-		wg := &sync.WaitGroup{}
-		wg.Add(1)
-		go w.onOnlineWrapper(id, wg)
-
-		chMsg := make(chan Message)
-		afterPing := false
-		to := time.NewTimer(TimeoutPing)
+	}()
+	h.OnReconnect(id)
+}
 
-	ReadLoop:
-		for {
-			go readMessage(conn, chMsg)
-			select {
-			case msg := <-chMsg:
-				if !to.Stop() {
-					<-to.C
-				}
-				if msg.Err == nil {
-					switch msg.Op {
-					case ws.OpPing:
-					case ws.OpPong:
-					case ws.OpText:
-						go w.onTextWrapper(id, msg.Body)
-					case ws.OpClose:
-						break ReadLoop
-					default:
-						w.l.Printf("[%d] Unknown received, OpCode: %v\n", id, msg.Op)
-					}
-					afterPing = false
-					to.Reset(TimeoutPing)
-				} else {
-					w.l.Printf("[%d] read error: %s\n", id, msg.Err)
-					break ReadLoop //EOF
-				}
-			case <-to.C:
-				if !afterPing {
-					go wsutil.WriteServerMessage(conn, ws.OpPing, []byte{})
-					afterPing = true
-					to.Reset(TimeoutClose)
-				} else {
-					w.l.Printf("[%d] Ping timeout...\n", id)
-					wsutil.WriteServerMessage(conn, ws.OpClose, []byte{0x03, 0xEA})
-					break ReadLoop
-				}
-			}
+func (w *WS) onConnectWrapper(c *client) {
+	if w.onConnect == nil {
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			w.l.Printf("[Recovery OnConnect] panic recovered:\n%s\n\n", r)
 		}
-		w.mutex.Lock()
-		if w.conns[id] == conn {
-			delete(w.conns, id)
-			w.mutex.Unlock()
+	}()
+	w.onConnect(c.info())
+}
 
-			wg.Wait()
+func (w *WS) onRebindWrapper(oldID, newID uint) {
+	if w.onRebind == nil {
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			w.l.Printf("[Recovery OnRebind] panic recovered:\n%s\n\n", r)
+		}
+	}()
+	w.onRebind(oldID, newID)
+}
 
-			go w.onOfflineWrapper(id)
-		} else {
-			w.mutex.Unlock()
+// onAuthWrapper returns the reason token is rejected, ErrAuthFailed unless
+// Handlers implement AuthErrHandlers or RequestAuthHandlers.
+func (w *WS) onAuthWrapper(req Request, token string) (id uint, err error) {
+	if w.allowAnon {
+		return w.anonymousID(), nil
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			id, err = 0, ErrAuthFailed
+			w.l.Printf("[Recovery OnAuth] panic recovered:\n%s\n\n", r)
 		}
-	} else {
-		w.l.Printf("%s: upgrade error: %v", nameConn(conn), err)
+	}()
+	if h, ok := w.h.(RequestAuthHandlers); ok {
+		return h.OnAuthRequest(req, token)
 	}
+	if h, ok := w.h.(AuthErrHandlers); ok {
+		return h.OnAuthErr(token)
+	}
+	if id, ok := w.h.OnAuth(token); ok {
+		return id, nil
+	}
+	return 0, ErrAuthFailed
 }
 
-func readMessage(rw io.ReadWriter, chMsg chan Message) {
-	s := ws.StateServerSide
-	ch := wsutil.ControlFrameHandler(rw, s)
+func (w *WS) anonymousID() uint {
+	return uint(atomic.AddUint64(&w.anonID, 1))
+}
 
-	rd := wsutil.Reader{
-		Source:         rw,
-		State:          s,
-		CheckUTF8:      true,
-		OnIntermediate: ch,
+func (w *WS) queryTokenValidatorWrapper(rawQuery string) (token string, ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			ok = false
+			w.l.Printf("[Recovery QueryTokenValidator] panic recovered:\n%s\n\n", r)
+		}
+	}()
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return "", false
 	}
+	return w.queryValidator(values)
+}
 
-	hdr, err := rd.NextFrame()
-	if err != nil {
-		chMsg <- Message{Err: err}
-		return
+// rejectAuth turns the auth failure reason into the handshake error built
+// by AuthRejection.
+func (w *WS) rejectAuth(reason error) (err error) {
+	if w.authRejection == nil {
+		return reason
 	}
-	if hdr.OpCode.IsControl() {
-		if err := ch(hdr, &rd); err != nil {
-			chMsg <- Message{Err: err}
-			return
+	defer func() {
+		if r := recover(); r != nil {
+			err = reason
+			w.l.Printf("[Recovery AuthRejection] panic recovered:\n%s\n\n", r)
 		}
-		chMsg <- Message{Op: hdr.OpCode}
-		return
+	}()
+	status, body := w.authRejection(reason)
+	if status == 0 {
+		status = http.StatusUnauthorized
 	}
+	return ws.RejectConnectionError(
+		ws.RejectionStatus(status),
+		ws.RejectionReason(body),
+	)
+}
 
-	bts, err := ioutil.ReadAll(&rd)
-
-	chMsg <- Message{
-		Body: bts,
-		Op:   hdr.OpCode,
-		Err:  err,
+// waitOnline waits for OnOnline of c to return, unless DecoupleOnline is
+// set.
+func (w *WS) waitOnline(c *client) {
+	if !w.decoupleOnline {
+		c.online.Wait()
 	}
-	return
 }
 
-func (w *WS) WriteMessage(id uint, msg []byte) error {
-	if w.onSendWrapper(id, msg) {
-		w.mutex.RLock()
-		defer w.mutex.RUnlock()
-		if conn, ok := w.conns[id]; ok {
-			err := wsutil.WriteServerMessage(conn, ws.OpText, msg)
-			if err != nil {
-				w.l.Printf("[%d] Write error: %s\n", id, err)
-			}
-			return err
+func (w *WS) onOnlineWrapper(c *client) {
+	defer c.online.Done()
+	id := c.ID()
+	w.emit(Event{Type: EventOnline, ID: id})
+	defer w.span(SpanOnOnline, AttrID, id)(nil)
+	atomic.AddInt64(&w.handlers, 1)
+	defer atomic.AddInt64(&w.handlers, -1)
+	defer func() {
+		if r := recover(); r != nil {
+			w.l.Printf("[Recovery OnOnline] panic recovered:\n%s\n\n", r)
+			w.onPanic(c)
 		}
-		w.l.Printf("Connection not found for device: %d\n", id)
-		return ErrConnNotFound
+	}()
+	w.h.OnOnline(id)
+}
+
+func (w *WS) pingIntervalWrapper(id uint) (d time.Duration) {
+	h, ok := w.h.(PingIntervalHandlers)
+	if !ok {
+		return TimeoutPing
 	}
-	return nil
+	defer func() {
+		if r := recover(); r != nil {
+			d = TimeoutPing
+			w.l.Printf("[Recovery PingInterval] panic recovered:\n%s\n\n", r)
+		}
+	}()
+	if d = h.PingInterval(id); d <= 0 {
+		d = TimeoutPing
+	}
+	return
 }
 
-func (w *WS) CloseConnection(id uint) error {
-	w.mutex.Lock()
-	defer w.mutex.Unlock()
-	if conn, ok := w.conns[id]; ok {
-		wsutil.WriteServerMessage(conn, ws.OpClose, []byte{0x03, 0xEA})
-		return conn.Close()
+func (w *WS) responseHeaderWrapper(id uint, req Request) (header http.Header) {
+	h, ok := w.h.(ResponseHeaderHandlers)
+	if !ok {
+		return nil
 	}
-	w.l.Printf("Connection not found for device: %d\n", id)
-	return ErrConnNotFound
+	defer func() {
+		if r := recover(); r != nil {
+			header = nil
+			w.l.Printf("[Recovery ResponseHeader] panic recovered:\n%s\n\n", r)
+		}
+	}()
+	return h.ResponseHeader(id, req)
 }
 
-func (w *WS) onAuthWrapper(token string) (id uint, ok bool) {
+func (w *WS) onReceiveWrapper(c *client, msg []byte) (out []byte, ok bool) {
+	if w.onReceive == nil {
+		return msg, true
+	}
 	defer func() {
 		if r := recover(); r != nil {
-			ok = false
-			w.l.Printf("[Recovery OnAuth] panic recovered:\n%s\n\n", r)
+			out, ok = msg, w.onPanic(c)
+			w.l.Printf("[Recovery OnReceive] panic recovered:\n%s\n\n", r)
 		}
 	}()
-	return w.h.OnAuth(token)
+	return w.onReceive(c.ID(), msg)
+}
+
+// logPayload logs p with LogPayloads, redacted by RedactFunc. RedactFunc
+// gets a copy of p, which is still to be written or handled.
+func (w *WS) logPayload(c *client, what string, p []byte) {
+	if !w.logPayloads {
+		return
+	}
+	if w.redact != nil {
+		defer func() {
+			if r := recover(); r != nil {
+				w.l.Printf("[Recovery RedactFunc] panic recovered:\n%s\n\n", r)
+			}
+		}()
+		p = w.redact(append([]byte(nil), p...))
+	}
+	w.l.Printf("[%s] %s: %q\n", c.logID(), what, p)
 }
 
-func (w *WS) onOnlineWrapper(id uint, wg *sync.WaitGroup) {
-	defer wg.Done()
+func (w *WS) acceptTextWrapper(c *client, msg []byte) (ok bool) {
+	if w.acceptText == nil {
+		return true
+	}
 	defer func() {
 		if r := recover(); r != nil {
-			w.l.Printf("[Recovery OnOnline] panic recovered:\n%s\n\n", r)
+			ok = w.onPanic(c)
+			w.l.Printf("[Recovery AcceptText] panic recovered:\n%s\n\n", r)
 		}
 	}()
-	w.h.OnOnline(id)
+	return w.acceptText(c.ID(), ConnState(atomic.LoadInt32(&c.state)), msg)
 }
 
-func (w *WS) onTextWrapper(id uint, msg []byte) {
+func (w *WS) onTextWrapper(ctx context.Context, c *client, msg []byte) {
+	id := c.ID()
+	w.emit(Event{Type: EventText, ID: id, Payload: msg})
+	defer w.span(SpanOnText, AttrID, id, AttrBytes, len(msg))(nil)
+	atomic.AddInt64(&w.handlers, 1)
+	defer atomic.AddInt64(&w.handlers, -1)
+	start := time.Now()
+	defer w.observeSince(ObserveOnText, start)
 	defer func() {
 		if r := recover(); r != nil {
 			w.l.Printf("[Recovery OnText] panic recovered:\n%s\n\n", r)
+			w.onPanic(c)
 		}
 	}()
-	w.h.OnText(id, msg)
+	if w.handlerTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, w.handlerTimeout)
+		defer cancel()
+	}
+	if h, ok := w.h.(ValueHandlers); ok {
+		v := h.NewValue(id)
+		if err := w.codec.Unmarshal(msg, v); err != nil {
+			w.l.Printf("[%s] Decode error: %s\n", c.logID(), err)
+			w.emit(Event{Type: EventError, ID: id, Payload: msg, Err: err})
+			return
+		}
+		h.OnValue(id, v)
+	} else if h, ok := w.h.(ContextTextHandlers); ok {
+		h.OnTextContext(ctx, id, msg)
+	} else {
+		w.h.OnText(id, msg)
+	}
+	if w.handlerTimeout > 0 && time.Since(start) > w.handlerTimeout {
+		w.l.Printf("[%s] OnText exceeded HandlerTimeout: %s\n", c.logID(), time.Since(start))
+	}
 }
 
 func (w *WS) onSendWrapper(id uint, msg []byte) (ok bool) {
 	defer func() {
 		if r := recover(); r != nil {
+			// OnSend is called for id, not a connection, so its current
+			// one is closed.
+			c, _ := w.conn(id)
+			ok = w.onPanic(c)
 			w.l.Printf("[Recovery OnWriteText] panic recovered:\n%s\n\n", r)
 		}
 	}()
 	return w.h.OnSend(id, msg)
 }
 
-func (w *WS) onOfflineWrapper(id uint) {
+// span starts a Tracer span of name with attrs given as key, value pairs.
+func (w *WS) span(name string, attrs ...interface{}) (end func(err error)) {
+	end = func(error) {}
+	if w.tracer == nil {
+		return
+	}
+	m := make(map[string]interface{}, len(attrs)/2)
+	for i := 0; i+1 < len(attrs); i += 2 {
+		m[attrs[i].(string)] = attrs[i+1]
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			w.l.Printf("[Recovery StartSpan] panic recovered:\n%s\n\n", r)
+		}
+	}()
+	if e := w.tracer.StartSpan(name, m); e != nil {
+		end = e
+	}
+	return
+}
+
+func (w *WS) observeSince(event string, start time.Time) {
+	if w.observe == nil {
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			w.l.Printf("[Recovery Observe] panic recovered:\n%s\n\n", r)
+		}
+	}()
+	w.observe(event, time.Since(start))
+}
+
+func (w *WS) onOfflineWrapper(id uint, reason OfflineReason) {
+	w.emit(Event{Type: EventOffline, ID: id})
+	atomic.AddInt64(&w.handlers, 1)
+	defer atomic.AddInt64(&w.handlers, -1)
 	defer func() {
 		if r := recover(); r != nil {
 			w.l.Printf("[Recovery OnOffline] panic recovered:\n%s\n\n", r)
 		}
 	}()
-	w.h.OnOffline(id)
+	if h, ok := w.h.(OfflineReasonHandlers); ok {
+		h.OnOfflineReason(id, reason)
+	} else {
+		w.h.OnOffline(id)
+	}
+}
+
+// Clean reports whether the client closed the connection normally, with
+// 1000 or 1001, as opposed to an error, a timeout or a close by the server.
+func (r OfflineReason) Clean() bool {
+	if _, ok := r.Err.(wsutil.ClosedError); !ok {
+		return false
+	}
+	return r.Code == ws.StatusNormalClosure || r.Code == ws.StatusGoingAway
+}
+
+// DefaultReadErrorCloseCode closes with 1002 after a protocol error, 1007
+// after invalid UTF-8 text, 1009 after a message over MaxMessageSize and
+// 1011 after other errors. Nothing is sent after a close frame or when the
+// connection itself failed.
+func DefaultReadErrorCloseCode(err error) ws.StatusCode {
+	if _, ok := err.(ws.ProtocolError); ok {
+		return ws.StatusProtocolError
+	}
+	if err == wsutil.ErrInvalidUTF8 {
+		return ws.StatusInvalidFramePayloadData
+	}
+	if err == ErrMessageTooBig {
+		return ws.StatusMessageTooBig
+	}
+	if _, ok := err.(wsutil.ClosedError); ok {
+		return 0
+	}
+	if _, ok := err.(net.Error); ok || err == io.EOF || err == io.ErrUnexpectedEOF || err == io.ErrClosedPipe || isClosedConnError(err) {
+		return 0
+	}
+	return ws.StatusInternalServerError
+}
+
+// readErrorCloseCode returns the ReadErrorCloseCode for err, 0 if it panics.
+func (w *WS) readErrorCloseCode(err error) (code ws.StatusCode) {
+	defer func() {
+		if r := recover(); r != nil {
+			code = 0
+			w.l.Printf("[Recovery ReadErrorCloseCode] panic recovered:\n%s\n\n", r)
+		}
+	}()
+	return w.readErrorCode(err)
+}
+
+// isCleanClose reports whether err is an expected end of connection: EOF,
+// a normal close frame from the peer or a read on a conn closed by us.
+func isCleanClose(err error) bool {
+	if err == io.EOF || isClosedConnError(err) {
+		return true
+	}
+	if ce, ok := err.(wsutil.ClosedError); ok {
+		switch ce.Code {
+		case ws.StatusNormalClosure, ws.StatusGoingAway, ws.StatusNoStatusRcvd:
+			return true
+		}
+	}
+	return false
+}
+
+func isClosedConnError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "use of closed network connection")
+}
+
+// queryParam returns the first value of key in rawQuery. Unlike
+// url.ParseQuery it keeps "+" literal, so base64 tokens survive unescaped.
+func queryParam(rawQuery, key string) (value string, ok bool) {
+	for _, kv := range strings.Split(rawQuery, "&") {
+		k, v := kv, ""
+		if i := strings.Index(kv, "="); i >= 0 {
+			k, v = kv[:i], kv[i+1:]
+		}
+		if k, err := url.PathUnescape(k); err != nil || k != key {
+			continue
+		}
+		if v, err := url.PathUnescape(v); err == nil {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+func newResumeToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// newConnID returns a random (version 4) UUID identifying a connection.
+func newConnID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// extensionNames returns the names of the extensions negotiated in hs.
+func extensionNames(hs ws.Handshake) []string {
+	if len(hs.Extensions) == 0 {
+		return nil
+	}
+	names := make([]string, len(hs.Extensions))
+	for i, opt := range hs.Extensions {
+		names[i] = string(opt.Name)
+	}
+	return names
+}
+
+// handshakeHeaders writes several handshake headers one after another.
+type handshakeHeaders []ws.HandshakeHeader
+
+func (hs handshakeHeaders) WriteTo(wr io.Writer) (n int64, err error) {
+	for _, h := range hs {
+		var m int64
+		m, err = h.WriteTo(wr)
+		n += m
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// isDeadConnError reports whether a write failed because the peer or we
+// already closed the connection.
+func isDeadConnError(err error) bool {
+	return isClosedConnError(err) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, syscall.ECONNRESET)
+}
+
+// isTemporary reports whether a write failed with a temporary net.Error,
+// e.g. a timeout, which WriteRetries may retry.
+func isTemporary(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Temporary()
 }
 
 func nameConn(conn net.Conn) string {
-	return conn.LocalAddr().String() + " > " + conn.RemoteAddr().String()
+	return addrString(conn.LocalAddr()) + " > " + addrString(conn.RemoteAddr())
+}
+
+// addrString formats a for logs: IP addresses as host:port with IPv6 hosts
+// in brackets, other networks prefixed with their name and a missing
+// address as "-".
+func addrString(a net.Addr) string {
+	if a == nil {
+		return "-"
+	}
+	host, port, err := splitAddr(a)
+	switch err {
+	case nil:
+		return net.JoinHostPort(host, port)
+	case errNilAddr:
+		return "-"
+	}
+	return a.Network() + ":" + a.String()
+}
+
+// splitAddr splits an IP address into host, without IPv6 brackets, and
+// port.
+func splitAddr(a net.Addr) (host, port string, err error) {
+	switch a := a.(type) {
+	case *net.TCPAddr:
+		if a == nil {
+			return "", "", errNilAddr
+		}
+		return ipString(a.IP, a.Zone), strconv.Itoa(a.Port), nil
+	case *net.UDPAddr:
+		if a == nil {
+			return "", "", errNilAddr
+		}
+		return ipString(a.IP, a.Zone), strconv.Itoa(a.Port), nil
+	}
+	return net.SplitHostPort(a.String())
+}
+
+func ipString(ip net.IP, zone string) string {
+	if len(ip) == 0 {
+		return ""
+	}
+	if zone != "" {
+		return ip.String() + "%" + zone
+	}
+	return ip.String()
 }
@@ -1,20 +1,63 @@
 package wsserver
 
 import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/gobwas/httphead"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
 	"github.com/gorilla/websocket"
 
 	. "github.com/smartystreets/goconvey/convey"
 )
 
 var wsServer *WS
-var runned []string
+var runned handlerCalls
+
+// handlerCalls records the calls of THandlers, which servers make
+// concurrently.
+type handlerCalls struct {
+	mutex sync.Mutex
+	calls []string
+}
+
+func (hc *handlerCalls) add(call string) {
+	hc.mutex.Lock()
+	hc.calls = append(hc.calls, call)
+	hc.mutex.Unlock()
+}
+
+func (hc *handlerCalls) reset() {
+	hc.mutex.Lock()
+	hc.calls = nil
+	hc.mutex.Unlock()
+}
+
+// list returns the recorded calls in order.
+func (hc *handlerCalls) list() []string {
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+	return append([]string{}, hc.calls...)
+}
 
 const (
 	onAuth = "OnAuth"
@@ -41,37 +84,37 @@ type THandlers struct{}
 
 func (h THandlers) SetConnCtrlr(ctrlr ConnController) {}
 func (h THandlers) OnAuth(token string) (id uint, ok bool) {
-	runned = append(runned, onAuth)
+	runned.add(onAuth)
 	return 1, true
 }
 func (h THandlers) OnOnline(id uint) {
-	runned = append(runned, onOnline)
+	runned.add(onOnline)
 }
 func (h THandlers) OnText(id uint, msg []byte) {
-	runned = append(runned, onText)
+	runned.add(onText)
 }
 func (h THandlers) OnSend(id uint, msg []byte) (ok bool) {
-	runned = append(runned, onSend)
+	runned.add(onSend)
 	return true
 }
 func (h THandlers) OnOffline(id uint) {
-	runned = append(runned, onOffline)
+	runned.add(onOffline)
 }
 
 func TestConnectHandlers(t *testing.T) {
 	Convey("Given WS server", t, func() {
 		Convey("When we connect by websocket to server", func() {
-			runned = make([]string, 0)
+			runned.reset()
 			c := setWSConnection()
 			Convey("Then 'OnAuth' handler should be runned", func() {
-				So(runned, ShouldContain, onAuth)
+				So(runned.list(), ShouldContain, onAuth)
 				Convey("And 'OnAuth' should be first", func() {
-					So(runned[0], ShouldEqual, onAuth)
+					So(runned.list()[0], ShouldEqual, onAuth)
 				})
 			})
 			Convey("Then 'OnOnline' handler should be runned", func() {
 				time.Sleep(time.Second * 1) //TODO: How test without sleep??
-				So(runned, ShouldContain, onOnline)
+				So(runned.list(), ShouldContain, onOnline)
 			})
 			Reset(func() {
 				c.Close()
@@ -83,7 +126,7 @@ func TestConnectHandlers(t *testing.T) {
 func TestConnectWithoutAuth(t *testing.T) {
 	Convey("Given WS server", t, func() {
 		Convey("When we connect by websocket to server without token", func() {
-			runned = make([]string, 0)
+			runned.reset()
 			u := url.URL{
 				Scheme: "ws",
 				Host:   "localhost:6008",
@@ -107,7 +150,7 @@ func TestConnectWithoutAuth(t *testing.T) {
 func TestConnectWithAuthorizationHeader(t *testing.T) {
 	Convey("Given WS server", t, func() {
 		Convey("When we connect by websocket to server with 'Authorization' header", func() {
-			runned = make([]string, 0)
+			runned.reset()
 			u := url.URL{
 				Scheme: "ws",
 				Host:   "localhost:6008",
@@ -121,14 +164,14 @@ func TestConnectWithAuthorizationHeader(t *testing.T) {
 			}
 
 			Convey("Then 'OnAuth' handler should be runned", func() {
-				So(runned, ShouldContain, onAuth)
+				So(runned.list(), ShouldContain, onAuth)
 				Convey("And 'OnAuth' should be first", func() {
-					So(runned[0], ShouldEqual, onAuth)
+					So(runned.list()[0], ShouldEqual, onAuth)
 				})
 			})
 			Convey("Then 'OnOnline' handler should be runned", func() {
 				time.Sleep(time.Second * 1) //TODO: How test without sleep??
-				So(runned, ShouldContain, onOnline)
+				So(runned.list(), ShouldContain, onOnline)
 			})
 			Reset(func() {
 				c.Close()
@@ -139,13 +182,13 @@ func TestConnectWithAuthorizationHeader(t *testing.T) {
 
 func TestReceiveMessageHandlers(t *testing.T) {
 	Convey("Given client with connection to server", t, func() {
-		runned = make([]string, 0)
+		runned.reset()
 		c := setWSConnection()
 		Convey("When we receive message", func() {
 			c.WriteMessage(websocket.TextMessage, []byte("Hello websocket! I'm client"))
 			Convey("Then 'OnText' handler should be runned", func() {
 				time.Sleep(time.Second * 1) //TODO: How test without sleep??
-				So(runned, ShouldContain, onText)
+				So(runned.list(), ShouldContain, onText)
 			})
 		})
 		Reset(func() {
@@ -156,7 +199,7 @@ func TestReceiveMessageHandlers(t *testing.T) {
 
 func TestSendMessageHandlers(t *testing.T) {
 	Convey("Given server with client connections", t, func() {
-		runned = make([]string, 0)
+		runned.reset()
 		var connID uint
 		c := setWSConnection()
 		Convey("When server send message to client", func() {
@@ -164,7 +207,7 @@ func TestSendMessageHandlers(t *testing.T) {
 				connID = 1
 				err := wsServer.WriteMessage(connID, []byte("Hello, i'm ws server"))
 				Convey("Then 'OnSend' handler should be runned", func() {
-					So(runned, ShouldContain, onSend)
+					So(runned.list(), ShouldContain, onSend)
 				})
 				Convey("Then err should be nil", func() {
 					So(err, ShouldBeNil)
@@ -189,13 +232,13 @@ func TestSendMessageHandlers(t *testing.T) {
 
 func TestDisconnectHandlers(t *testing.T) {
 	Convey("Given server with client connections", t, func() {
-		runned = make([]string, 0)
+		runned.reset()
 		c := setWSConnection()
 		Convey("When client close connection with server", func() {
 			c.Close()
 			Convey("Then 'OnOffline' handler should be runned", func() {
 				time.Sleep(time.Second * 1) //TODO: How test without sleep??
-				So(runned, ShouldContain, onOffline)
+				So(runned.list(), ShouldContain, onOffline)
 			})
 		})
 		Reset(func() {
@@ -206,13 +249,13 @@ func TestDisconnectHandlers(t *testing.T) {
 
 func TestCloseConnectionHandlers(t *testing.T) {
 	Convey("Given server with client connections", t, func() {
-		runned = make([]string, 0)
+		runned.reset()
 		c := setWSConnection()
 		Convey("When server close connection with client", func() {
 			wsServer.CloseConnection(1)
 			Convey("Then 'OnOffline' handler should be runned", func() {
 				time.Sleep(time.Second * 1) //TODO: How test without sleep??
-				So(runned, ShouldContain, onOffline)
+				So(runned.list(), ShouldContain, onOffline)
 			})
 		})
 		Reset(func() {
@@ -221,18 +264,3808 @@ func TestCloseConnectionHandlers(t *testing.T) {
 	})
 }
 
-func setWSConnection() *websocket.Conn {
-	u := url.URL{
-		Scheme:   "ws",
-		Host:     "localhost:6008",
-		Path:     "/",
-		RawQuery: "token=123456",
+func TestCloseConnectionAndWait(t *testing.T) {
+	Convey("Given WS server with a connected client", t, func() {
+		h := lifecycleHandlers{events: make(chan string, 10)}
+		srv, err := startTestServer(&Config{
+			Addr:     "localhost:0",
+			Handlers: h,
+		})
+		So(err, ShouldBeNil)
+		c, _, err := dialTestServer(srv, "token=123456", nil)
+		So(err, ShouldBeNil)
+		So(<-h.events, ShouldEqual, onOnline)
+		Convey("When server closes the connection and waits", func() {
+			err := srv.CloseConnectionAndWait(context.Background(), 1)
+			Convey("Then 'OnOffline' should have run when it returns", func() {
+				So(err, ShouldBeNil)
+				So(len(h.events), ShouldEqual, 1)
+				So(<-h.events, ShouldEqual, onOffline)
+				_, err = srv.ConnInfo(1)
+				So(err, ShouldEqual, ErrConnNotFound)
+			})
+		})
+		Convey("Waiting for an unknown id should fail", func() {
+			So(srv.CloseConnectionAndWait(context.Background(), 2), ShouldEqual, ErrConnNotFound)
+		})
+		Reset(func() {
+			c.Close()
+		})
+	})
+	Convey("Given WS server deferring OnOffline by ResumeTimeout", t, func() {
+		srv, err := startTestServer(&Config{
+			Addr:          "localhost:0",
+			Handlers:      THandlers{},
+			ResumeTimeout: time.Minute,
+		})
+		So(err, ShouldBeNil)
+		c, _, err := dialTestServer(srv, "token=123456", nil)
+		So(err, ShouldBeNil)
+		Convey("Then waiting should end with the context", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			So(srv.CloseConnectionAndWait(ctx, 1) == context.DeadlineExceeded, ShouldBeTrue)
+		})
+		Reset(func() {
+			c.Close()
+		})
+	})
+}
+
+func TestOnAccept(t *testing.T) {
+	Convey("Given WS server with OnAccept hook rejecting connections", t, func() {
+		accepted := make(chan string, 1)
+		srv, err := startTestServer(&Config{
+			Addr:     "localhost:0",
+			Handlers: THandlers{},
+			OnAccept: func(conn net.Conn) bool {
+				accepted <- conn.RemoteAddr().String()
+				return false
+			},
+		})
+		So(err, ShouldBeNil)
+		Convey("When we connect by websocket to server", func() {
+			runned.reset()
+			_, _, err := dialTestServer(srv, "token=123456", nil)
+			Convey("Then 'OnAccept' should be called with the raw conn", func() {
+				So(<-accepted, ShouldNotBeEmpty)
+			})
+			Convey("Then handshake should fail without calling 'OnAuth'", func() {
+				So(err, ShouldNotBeNil)
+				So(runned.list(), ShouldNotContain, onAuth)
+			})
+		})
+	})
+}
+
+func TestUpgraderConfig(t *testing.T) {
+	Convey("Given WS server with a custom upgrader configuration", t, func() {
+		headers := make(chan string, 1)
+		srv, err := startTestServer(&Config{
+			Addr:     "localhost:0",
+			Handlers: THandlers{},
+			Upgrader: func(u *ws.Upgrader) {
+				u.Protocol = func(p []byte) bool {
+					return string(p) == "chat"
+				}
+				u.OnHeader = func(key, value []byte) error {
+					if string(key) == "X-Client" {
+						headers <- string(value)
+					}
+					return nil
+				}
+			},
+		})
+		So(err, ShouldBeNil)
+		Convey("When we connect with a subprotocol and a custom header", func() {
+			d := websocket.Dialer{Subprotocols: []string{"chat"}}
+			u := url.URL{Scheme: "ws", Host: srv.addr, Path: "/", RawQuery: "token=123456"}
+			c, _, err := d.Dial(u.String(), http.Header{"X-Client": []string{"test"}})
+			So(err, ShouldBeNil)
+			Convey("Then the custom protocol selector should be applied", func() {
+				So(c.Subprotocol(), ShouldEqual, "chat")
+			})
+			Convey("Then the custom header hook should be called", func() {
+				So(<-headers, ShouldEqual, "test")
+			})
+			Reset(func() {
+				c.Close()
+			})
+		})
+	})
+}
+
+func TestResumeSession(t *testing.T) {
+	Convey("Given WS server with session resume enabled", t, func() {
+		srv, err := startTestServer(&Config{
+			Addr:          "localhost:0",
+			Handlers:      THandlers{},
+			ResumeTimeout: 2 * time.Second,
+		})
+		So(err, ShouldBeNil)
+		Convey("When client reconnects with the resume token within the timeout", func() {
+			c, resp, err := dialTestServer(srv, "token=123456", nil)
+			So(err, ShouldBeNil)
+			token := resp.Header.Get(ResumeTokenHeader)
+			So(token, ShouldNotBeEmpty)
+			time.Sleep(time.Millisecond * 300)
+			runned.reset()
+			c.Close()
+			time.Sleep(time.Millisecond * 300)
+
+			c, _, err = dialTestServer(srv, ResumeTokenKey+"="+token, nil)
+			So(err, ShouldBeNil)
+			time.Sleep(time.Millisecond * 300)
+			Convey("Then session should continue without 'OnAuth', 'OnOnline' or 'OnOffline'", func() {
+				So(runned.list(), ShouldBeEmpty)
+			})
+			Reset(func() {
+				c.Close()
+			})
+		})
+	})
+}
+
+func TestObserve(t *testing.T) {
+	Convey("Given WS server with a duration observer", t, func() {
+		events := make(chan string, 2)
+		srv, err := startTestServer(&Config{
+			Addr:     "localhost:0",
+			Handlers: THandlers{},
+			Observe: func(event string, d time.Duration) {
+				events <- event
+			},
+		})
+		So(err, ShouldBeNil)
+		c, _, err := dialTestServer(srv, "token=123456", nil)
+		So(err, ShouldBeNil)
+		So(<-events, ShouldEqual, ObserveHandshake)
+		time.Sleep(time.Millisecond * 300)
+		Convey("When client sends a message", func() {
+			c.WriteMessage(websocket.TextMessage, []byte("hello"))
+			Convey("Then the OnText duration should be observed", func() {
+				So(<-events, ShouldEqual, ObserveOnText)
+			})
+		})
+		Convey("When server writes a message", func() {
+			So(srv.WriteMessage(1, []byte("hello")), ShouldBeNil)
+			Convey("Then the write duration should be observed", func() {
+				So(<-events, ShouldEqual, ObserveWrite)
+			})
+		})
+		Reset(func() {
+			c.Close()
+		})
+	})
+}
+
+type orderHandlers struct {
+	THandlers
+	texts chan string
+}
+
+func (h orderHandlers) OnText(id uint, msg []byte) {
+	h.texts <- string(msg)
+}
+
+func TestOrderedDelivery(t *testing.T) {
+	Convey("Given WS server with ordered delivery", t, func() {
+		h := orderHandlers{texts: make(chan string, 100)}
+		srv, err := startTestServer(&Config{
+			Addr:            "localhost:0",
+			Handlers:        h,
+			OrderedDelivery: true,
+		})
+		So(err, ShouldBeNil)
+		c, _, err := dialTestServer(srv, "token=123456", nil)
+		So(err, ShouldBeNil)
+		Convey("When client sends several messages", func() {
+			for i := 0; i < 100; i++ {
+				c.WriteMessage(websocket.TextMessage, []byte(strconv.Itoa(i)))
+			}
+			Convey("Then 'OnText' should receive them in order", func() {
+				for i := 0; i < 100; i++ {
+					So(<-h.texts, ShouldEqual, strconv.Itoa(i))
+				}
+			})
+		})
+		Reset(func() {
+			c.Close()
+		})
+	})
+}
+
+func TestHealthProbe(t *testing.T) {
+	Convey("Given WS server with a health probe", t, func() {
+		srv, err := startTestServer(&Config{
+			Addr:       "localhost:0",
+			Handlers:   THandlers{},
+			HealthAddr: "localhost:0",
+		})
+		So(err, ShouldBeNil)
+		url := "http://" + srv.hln.Addr().String() + "/"
+		Convey("When we request the probe", func() {
+			resp, err := http.Get(url)
+			So(err, ShouldBeNil)
+			defer resp.Body.Close()
+			var st healthStatus
+			So(json.NewDecoder(resp.Body).Decode(&st), ShouldBeNil)
+			Convey("Then it should report a listening server", func() {
+				So(resp.StatusCode, ShouldEqual, http.StatusOK)
+				So(st.Listening, ShouldBeTrue)
+				So(st.Connections, ShouldEqual, 0)
+			})
+		})
+		Convey("When the server shuts down", func() {
+			So(srv.Shutdown(context.Background()), ShouldBeNil)
+			Convey("Then the probe should report it not listening", func() {
+				rec := httptest.NewRecorder()
+				srv.serveHealth(rec, httptest.NewRequest("GET", "/", nil))
+				var st healthStatus
+				So(json.NewDecoder(rec.Body).Decode(&st), ShouldBeNil)
+				So(rec.Code, ShouldEqual, http.StatusServiceUnavailable)
+				So(st.Listening, ShouldBeFalse)
+				So(st.Error, ShouldEqual, ErrServerClosed.Error())
+			})
+			Convey("Then the probe listener should be closed", func() {
+				_, err := http.Get(url)
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
+
+func TestCoalesceWindow(t *testing.T) {
+	Convey("Given WS server with a coalesce window", t, func() {
+		srv, err := startTestServer(&Config{
+			Addr:           "localhost:0",
+			Handlers:       THandlers{},
+			CoalesceWindow: 100 * time.Millisecond,
+		})
+		So(err, ShouldBeNil)
+		c, _, err := dialTestServer(srv, "token=123456", nil)
+		So(err, ShouldBeNil)
+		time.Sleep(time.Millisecond * 300)
+		Convey("When server writes several messages within the window", func() {
+			for _, m := range []string{"a", "b", "c"} {
+				So(srv.WriteMessage(1, []byte(m)), ShouldBeNil)
+			}
+			Convey("Then client should receive them in one frame", func() {
+				_, msg, err := c.ReadMessage()
+				So(err, ShouldBeNil)
+				So(string(msg), ShouldEqual, "a\nb\nc")
+			})
+			Convey("Then they should be queued until the window ends", func() {
+				depth, ok := srv.QueueDepth(1)
+				So(ok, ShouldBeTrue)
+				So(depth, ShouldEqual, 3)
+			})
+			Convey("Then 'Flush' should write them at once", func() {
+				So(srv.Flush(1), ShouldBeNil)
+				depth, _ := srv.QueueDepth(1)
+				So(depth, ShouldEqual, 0)
+				_, msg, err := c.ReadMessage()
+				So(err, ShouldBeNil)
+				So(string(msg), ShouldEqual, "a\nb\nc")
+			})
+		})
+		Convey("Flushing an unknown id should fail", func() {
+			So(srv.Flush(5), ShouldEqual, ErrConnNotFound)
+		})
+		Reset(func() {
+			c.Close()
+		})
+	})
+}
+
+func TestOnAuthReject(t *testing.T) {
+	Convey("Given WS server with OnAuthReject hook", t, func() {
+		rejects := make(chan error, 1)
+		srv, err := startTestServer(&Config{
+			Addr:     "localhost:0",
+			Handlers: THandlers{},
+			OnAuthReject: func(remoteAddr string, reason error) {
+				rejects <- reason
+			},
+		})
+		So(err, ShouldBeNil)
+		Convey("When we connect without token", func() {
+			_, _, err := dialTestServer(srv, "", nil)
+			So(err, ShouldNotBeNil)
+			Convey("Then 'OnAuthReject' should be called with 'ErrNotAuth'", func() {
+				So(<-rejects, ShouldEqual, ErrNotAuth)
+			})
+		})
+		Convey("When we connect with an unknown auth scheme", func() {
+			_, _, err := dialTestServer(srv, "", http.Header{
+				"Authorization": []string{"Digest 123456"},
+			})
+			So(err, ShouldNotBeNil)
+			Convey("Then 'OnAuthReject' should be called with 'ErrBadAuthHeader'", func() {
+				So(<-rejects, ShouldEqual, ErrBadAuthHeader)
+			})
+		})
+	})
+}
+
+var errTokenExpired = errors.New("Token expired")
+
+type authErrHandlers struct {
+	THandlers
+}
+
+func (h authErrHandlers) OnAuthErr(token string) (id uint, err error) {
+	if token == "expired" {
+		return 0, errTokenExpired
 	}
-	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
-	if err != nil {
-		log.Print(err)
+	return 1, nil
+}
+
+func TestAuthRejection(t *testing.T) {
+	Convey("Given WS server describing auth rejections", t, func() {
+		srv, err := startTestServer(&Config{
+			Addr:     "localhost:0",
+			Handlers: authErrHandlers{},
+			AuthRejection: func(reason error) (int, string) {
+				return 0, `{"error":"` + reason.Error() + `"}`
+			},
+		})
+		So(err, ShouldBeNil)
+		Convey("When we connect with an expired token", func() {
+			_, resp, err := dialTestServer(srv, "token=expired", nil)
+			So(err, ShouldNotBeNil)
+			Convey("Then the response should be a 401 with the reason", func() {
+				So(resp.StatusCode, ShouldEqual, http.StatusUnauthorized)
+				body, _ := ioutil.ReadAll(resp.Body)
+				So(string(body), ShouldEqual, `{"error":"Token expired"}`)
+			})
+		})
+		Convey("When we connect with a valid token", func() {
+			c, _, err := dialTestServer(srv, "token=valid", nil)
+			Convey("Then handshake should succeed", func() {
+				So(err, ShouldBeNil)
+				c.Close()
+			})
+		})
+	})
+}
+
+type requestHandlers struct {
+	THandlers
+	paths chan string
+}
+
+func (h requestHandlers) OnAuthRequest(req Request, token string) (id uint, err error) {
+	h.paths <- req.Path
+	return 1, nil
+}
+
+func TestRequestPath(t *testing.T) {
+	Convey("Given WS server with handlers routing by path", t, func() {
+		h := requestHandlers{paths: make(chan string, 1)}
+		srv, err := startTestServer(&Config{
+			Addr:     "localhost:0",
+			Handlers: h,
+		})
+		So(err, ShouldBeNil)
+		Convey("When we connect to a room path", func() {
+			u := url.URL{Scheme: "ws", Host: srv.addr, Path: "/rooms/42", RawQuery: "token=1"}
+			c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+			So(err, ShouldBeNil)
+			Convey("Then 'OnAuthRequest' should receive the path", func() {
+				So(<-h.paths, ShouldEqual, "/rooms/42")
+			})
+			Convey("Then 'Request' should return the path and query", func() {
+				time.Sleep(time.Millisecond * 100)
+				req, err := srv.Request(1)
+				So(err, ShouldBeNil)
+				So(req, ShouldResemble, Request{Path: "/rooms/42", RawQuery: "token=1"})
+			})
+			Reset(func() {
+				c.Close()
+			})
+		})
+	})
+}
+
+type cookieHandlers struct {
+	tokenHandlers
+}
+
+func (h cookieHandlers) ResponseHeader(id uint, req Request) http.Header {
+	return http.Header{"Set-Cookie": []string{"session=" + strconv.Itoa(int(id))}}
+}
+
+func TestResponseHeader(t *testing.T) {
+	Convey("Given WS server adding response headers", t, func() {
+		srv, err := startTestServer(&Config{
+			Addr:           "localhost:0",
+			Handlers:       cookieHandlers{},
+			ResponseHeader: http.Header{"X-Server-Version": []string{"1.2.3"}},
+		})
+		So(err, ShouldBeNil)
+		Convey("When a client connects", func() {
+			c, resp, err := dialTestServer(srv, "token=7", nil)
+			So(err, ShouldBeNil)
+			Convey("Then the 101 response should carry the static and per-connection headers", func() {
+				So(resp.Header.Get("X-Server-Version"), ShouldEqual, "1.2.3")
+				So(resp.Header.Get("Set-Cookie"), ShouldEqual, "session=7")
+			})
+			Reset(func() {
+				c.Close()
+			})
+		})
+	})
+}
+
+func TestQueryTokenValidator(t *testing.T) {
+	Convey("Given WS server validating signed query tokens", t, func() {
+		srv, err := startTestServer(&Config{
+			Addr:     "localhost:0",
+			Handlers: tokenHandlers{},
+			QueryTokenValidator: func(values url.Values) (string, bool) {
+				return values.Get("t"), values.Get("sig") == "ok"
+			},
+		})
+		So(err, ShouldBeNil)
+		Convey("When we connect with a valid signature", func() {
+			c, _, err := dialTestServer(srv, "t=7&sig=ok", nil)
+			Convey("Then the validated token should authenticate", func() {
+				So(err, ShouldBeNil)
+				time.Sleep(time.Millisecond * 100)
+				_, err := srv.State(7)
+				So(err, ShouldBeNil)
+				c.Close()
+			})
+		})
+		Convey("When we connect with a bad signature", func() {
+			_, _, err := dialTestServer(srv, "t=7&sig=bad", nil)
+			Convey("Then handshake should fail", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
+
+func TestMaxHandshakeHeaderBytes(t *testing.T) {
+	Convey("Given WS server with a handshake header limit", t, func() {
+		srv, err := startTestServer(&Config{
+			Addr:                    "localhost:0",
+			Handlers:                THandlers{},
+			MaxHandshakeHeaderBytes: 64,
+		})
+		So(err, ShouldBeNil)
+		Convey("When we connect with too large headers", func() {
+			_, resp, err := dialTestServer(srv, "token=123456", http.Header{
+				"X-Padding": []string{strings.Repeat("a", 128)},
+			})
+			Convey("Then handshake should fail with 431", func() {
+				So(err, ShouldNotBeNil)
+				So(resp.StatusCode, ShouldEqual, http.StatusRequestHeaderFieldsTooLarge)
+			})
+		})
+	})
+}
+
+type lifecycleHandlers struct {
+	THandlers
+	events chan string
+}
+
+func (h lifecycleHandlers) OnOnline(id uint) {
+	h.events <- onOnline
+}
+func (h lifecycleHandlers) OnOffline(id uint) {
+	h.events <- onOffline
+}
+
+type graceHandlers struct {
+	lifecycleHandlers
+}
+
+func (h graceHandlers) OnReconnect(id uint) {
+	h.events <- "OnReconnect"
+}
+
+// gatedTextHandlers record lifecycle events and 'OnText' once gate is
+// closed.
+type gatedTextHandlers struct {
+	lifecycleHandlers
+	gate chan struct{}
+}
+
+func (h gatedTextHandlers) OnText(id uint, msg []byte) {
+	<-h.gate
+	h.events <- onText
+}
+
+func TestReplacedOrderedDelivery(t *testing.T) {
+	Convey("Given WS server with ordered delivery busy in 'OnText'", t, func() {
+		h := gatedTextHandlers{
+			lifecycleHandlers: lifecycleHandlers{events: make(chan string, 10)},
+			gate:              make(chan struct{}),
+		}
+		srv, err := startTestServer(&Config{
+			Addr:            "localhost:0",
+			Handlers:        h,
+			OrderedDelivery: true,
+		})
+		So(err, ShouldBeNil)
+		c1, _, err := dialTestServer(srv, "token=123456", nil)
+		So(err, ShouldBeNil)
+		So(<-h.events, ShouldEqual, onOnline)
+		So(c1.WriteMessage(websocket.TextMessage, []byte("hello")), ShouldBeNil)
+		time.Sleep(time.Millisecond * 100)
+		Convey("When the client reconnects", func() {
+			c2, _, err := dialTestServer(srv, "token=123456", nil)
+			So(err, ShouldBeNil)
+			Convey("Then 'OnOffline' of the replaced connection should wait for 'OnText'", func() {
+				So(receivedEvents(h.events, time.Millisecond*100), ShouldBeEmpty)
+				close(h.gate)
+				So(receivedEvents(h.events, time.Millisecond*100), ShouldResemble, []string{onText, onOffline, onOnline})
+			})
+			Reset(func() {
+				c2.Close()
+			})
+		})
+		Reset(func() {
+			c1.Close()
+		})
+	})
+}
+
+func TestOfflineGrace(t *testing.T) {
+	Convey("Given WS server with an offline grace period", t, func() {
+		h := graceHandlers{lifecycleHandlers{events: make(chan string, 10)}}
+		srv, err := startTestServer(&Config{
+			Addr:         "localhost:0",
+			Handlers:     h,
+			OfflineGrace: 300 * time.Millisecond,
+		})
+		So(err, ShouldBeNil)
+		c, resp, err := dialTestServer(srv, "token=123456", nil)
+		So(err, ShouldBeNil)
+		So(resp.Header.Get(ResumeTokenHeader), ShouldBeEmpty)
+		So(<-h.events, ShouldEqual, onOnline)
+		c.Close()
+		Convey("When the id reconnects within the grace period", func() {
+			time.Sleep(100 * time.Millisecond)
+			c2, _, err := dialTestServer(srv, "token=123456", nil)
+			So(err, ShouldBeNil)
+			Convey("Then only 'OnReconnect' should fire", func() {
+				So(receivedEvents(h.events, 500*time.Millisecond), ShouldResemble, []string{"OnReconnect"})
+			})
+			Reset(func() {
+				c2.Close()
+			})
+		})
+		Convey("When it stays away", func() {
+			Convey("Then 'OnOffline' should fire after the grace period", func() {
+				So(receivedEvents(h.events, 200*time.Millisecond), ShouldBeEmpty)
+				So(receivedEvents(h.events, 300*time.Millisecond), ShouldResemble, []string{onOffline})
+			})
+		})
+	})
+}
+
+func receivedEvents(events chan string, wait time.Duration) []string {
+	got := make([]string, 0)
+	timeout := time.After(wait)
+	for {
+		select {
+		case e := <-events:
+			got = append(got, e)
+		case <-timeout:
+			return got
+		}
 	}
-	//log.Printf("connection from: %v", c.LocalAddr())
+}
 
-	return c
+func TestOnOfflineExactlyOnce(t *testing.T) {
+	Convey("Given WS server with a connected client", t, func() {
+		h := lifecycleHandlers{events: make(chan string, 10)}
+		srv, err := startTestServer(&Config{
+			Addr:     "localhost:0",
+			Handlers: h,
+		})
+		So(err, ShouldBeNil)
+		c, _, err := dialTestServer(srv, "token=123456", nil)
+		So(err, ShouldBeNil)
+		So(<-h.events, ShouldEqual, onOnline)
+		Convey("When the same id connects again", func() {
+			c2, _, err := dialTestServer(srv, "token=123456", nil)
+			So(err, ShouldBeNil)
+			Convey("Then 'OnOffline' of the replaced connection should run before 'OnOnline'", func() {
+				So(receivedEvents(h.events, time.Millisecond*300), ShouldResemble, []string{onOffline, onOnline})
+			})
+			Reset(func() {
+				c2.Close()
+			})
+		})
+		Convey("When the connection is closed by both sides", func() {
+			srv.CloseConnection(1)
+			srv.CloseConnection(1)
+			c.Close()
+			Convey("Then 'OnOffline' should run once", func() {
+				So(receivedEvents(h.events, time.Millisecond*300), ShouldResemble, []string{onOffline})
+			})
+		})
+		Reset(func() {
+			c.Close()
+		})
+	})
+}
+
+type pingHandlers struct {
+	THandlers
+}
+
+func (h pingHandlers) PingInterval(id uint) time.Duration {
+	return 200 * time.Millisecond
+}
+
+func TestPingInterval(t *testing.T) {
+	Convey("Given WS server with handlers overriding the ping interval", t, func() {
+		srv, err := startTestServer(&Config{
+			Addr:     "localhost:0",
+			Handlers: pingHandlers{},
+		})
+		So(err, ShouldBeNil)
+		Convey("When client stays idle", func() {
+			c, _, err := dialTestServer(srv, "token=123456", nil)
+			So(err, ShouldBeNil)
+			pings := make(chan struct{}, 1)
+			c.SetPingHandler(func(string) error {
+				pings <- struct{}{}
+				return nil
+			})
+			go c.ReadMessage()
+			Convey("Then server should ping it after the custom interval", func() {
+				received := false
+				select {
+				case <-pings:
+					received = true
+				case <-time.After(time.Second):
+				}
+				So(received, ShouldBeTrue)
+			})
+			Reset(func() {
+				c.Close()
+			})
+		})
+	})
+}
+
+func TestPingAlways(t *testing.T) {
+	for _, pingAlways := range []bool{true, false} {
+		Convey("Given WS server pinging every 200ms with PingAlways "+strconv.FormatBool(pingAlways), t, func() {
+			srv, err := startTestServer(&Config{
+				Addr:       "localhost:0",
+				Handlers:   pingHandlers{},
+				PingAlways: pingAlways,
+			})
+			So(err, ShouldBeNil)
+			c, _, err := dialTestServer(srv, "token=123456", nil)
+			So(err, ShouldBeNil)
+			pings := make(chan struct{}, 10)
+			c.SetPingHandler(func(data string) error {
+				pings <- struct{}{}
+				return c.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+			})
+			go c.ReadMessage()
+			Convey("When client sends a message every 50ms", func() {
+				for i := 0; i < 12; i++ {
+					So(c.WriteMessage(websocket.TextMessage, []byte("tick")), ShouldBeNil)
+					time.Sleep(50 * time.Millisecond)
+				}
+				if pingAlways {
+					Convey("Then server should ping it anyway", func() {
+						So(len(pings), ShouldBeGreaterThanOrEqualTo, 2)
+					})
+				} else {
+					Convey("Then server should not ping it", func() {
+						So(len(pings), ShouldEqual, 0)
+					})
+				}
+			})
+			Reset(func() {
+				c.Close()
+			})
+		})
+	}
+}
+
+func TestOnlineIDs(t *testing.T) {
+	Convey("Given WS server with two connected clients", t, func() {
+		srv, err := startTestServer(&Config{
+			Addr:     "localhost:0",
+			Handlers: tokenHandlers{},
+		})
+		So(err, ShouldBeNil)
+		So(srv.OnlineIDs(), ShouldBeEmpty)
+		c1, _, err := dialTestServer(srv, "token=1", nil)
+		So(err, ShouldBeNil)
+		c2, _, err := dialTestServer(srv, "token=2", nil)
+		So(err, ShouldBeNil)
+		Convey("Then OnlineIDs should return both ids", func() {
+			ids := srv.OnlineIDs()
+			So(ids, ShouldHaveLength, 2)
+			So(ids, ShouldContain, uint(1))
+			So(ids, ShouldContain, uint(2))
+		})
+		Convey("Then RangeOnline should stop when told to", func() {
+			seen := 0
+			srv.RangeOnline(func(id uint) bool {
+				seen++
+				return false
+			})
+			So(seen, ShouldEqual, 1)
+		})
+		Reset(func() {
+			c1.Close()
+			c2.Close()
+		})
+	})
+}
+
+func TestStaleConns(t *testing.T) {
+	Convey("Given WS server pinging every 200ms", t, func() {
+		srv, err := startTestServer(&Config{
+			Addr:     "localhost:0",
+			Handlers: pingHandlers{},
+		})
+		So(err, ShouldBeNil)
+		c, _, err := dialTestServer(srv, "token=123456", nil)
+		So(err, ShouldBeNil)
+		Convey("When client doesn't answer pings", func() {
+			time.Sleep(300 * time.Millisecond)
+			Convey("Then it should be stale", func() {
+				So(len(srv.StaleConns(250*time.Millisecond)), ShouldEqual, 1)
+				Convey("Until it answers again", func() {
+					go c.ReadMessage()
+					time.Sleep(100 * time.Millisecond)
+					So(srv.StaleConns(250*time.Millisecond), ShouldBeEmpty)
+				})
+			})
+		})
+		Reset(func() {
+			c.Close()
+		})
+	})
+}
+
+func TestLastRTT(t *testing.T) {
+	Convey("Given WS server pinging every 200ms", t, func() {
+		srv, err := startTestServer(&Config{
+			Addr:     "localhost:0",
+			Handlers: pingHandlers{},
+		})
+		So(err, ShouldBeNil)
+		c, _, err := dialTestServer(srv, "token=123456", nil)
+		So(err, ShouldBeNil)
+		info, err := srv.ConnInfo(1)
+		So(err, ShouldBeNil)
+		So(info.LastRTT, ShouldEqual, 0)
+		Convey("When client answers a ping after 50ms", func() {
+			pongs := make(chan struct{}, 1)
+			c.SetPingHandler(func(data string) error {
+				time.Sleep(50 * time.Millisecond)
+				err := c.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+				pongs <- struct{}{}
+				return err
+			})
+			go c.ReadMessage()
+			Convey("Then ConnInfo should report the round trip", func() {
+				<-pongs
+				time.Sleep(50 * time.Millisecond)
+				info, err := srv.ConnInfo(1)
+				So(err, ShouldBeNil)
+				So(info.LastRTT, ShouldBeGreaterThanOrEqualTo, 50*time.Millisecond)
+				So(info.LastRTT, ShouldBeLessThan, time.Second)
+			})
+		})
+		Reset(func() {
+			c.Close()
+		})
+	})
+}
+
+func TestDisablePing(t *testing.T) {
+	Convey("Given WS server with pings disabled and an idle timeout", t, func() {
+		srv, err := startTestServer(&Config{
+			Addr:        "localhost:0",
+			Handlers:    pingHandlers{},
+			DisablePing: true,
+			IdleTimeout: 600 * time.Millisecond,
+		})
+		So(err, ShouldBeNil)
+		Convey("When client stays idle", func() {
+			c, _, err := dialTestServer(srv, "token=123456", nil)
+			So(err, ShouldBeNil)
+			pings := make(chan struct{}, 1)
+			c.SetPingHandler(func(string) error {
+				pings <- struct{}{}
+				return nil
+			})
+			readErr := make(chan error, 1)
+			go func() {
+				_, _, err := c.ReadMessage()
+				readErr <- err
+			}()
+			Convey("Then server should not ping it but close it when idle", func() {
+				var err error
+				select {
+				case <-pings:
+				case err = <-readErr:
+				}
+				So(websocket.IsCloseError(err, websocket.CloseGoingAway), ShouldBeTrue)
+			})
+			Reset(func() {
+				c.Close()
+			})
+		})
+	})
+}
+
+func TestEmptyTextKeepalive(t *testing.T) {
+	Convey("Given WS server treating empty text frames as keepalives", t, func() {
+		h := orderHandlers{texts: make(chan string, 10)}
+		srv, err := startTestServer(&Config{
+			Addr:               "localhost:0",
+			Handlers:           h,
+			OrderedDelivery:    true,
+			IdleTimeout:        400 * time.Millisecond,
+			EmptyTextKeepalive: true,
+		})
+		So(err, ShouldBeNil)
+		c, _, err := dialTestServer(srv, "token=123456", nil)
+		So(err, ShouldBeNil)
+		Convey("When client sends only keepalives for longer than the idle timeout", func() {
+			for i := 0; i < 4; i++ {
+				So(c.WriteMessage(websocket.TextMessage, nil), ShouldBeNil)
+				time.Sleep(200 * time.Millisecond)
+			}
+			c.WriteMessage(websocket.TextMessage, []byte("hello"))
+			Convey("Then the connection should stay open and OnText skip the keepalives", func() {
+				So(<-h.texts, ShouldEqual, "hello")
+				So(len(h.texts), ShouldEqual, 0)
+			})
+		})
+		Reset(func() {
+			c.Close()
+		})
+	})
+}
+
+type reasonHandlers struct {
+	THandlers
+	reasons chan OfflineReason
+}
+
+func (h reasonHandlers) OnOfflineReason(id uint, reason OfflineReason) {
+	h.reasons <- reason
+}
+
+func TestIdleCloseCode(t *testing.T) {
+	Convey("Given WS server closing idle connections with an application code", t, func() {
+		h := reasonHandlers{reasons: make(chan OfflineReason, 1)}
+		clock := newFakeClock()
+		srv, err := startTestServer(&Config{
+			Addr:          "localhost:0",
+			Handlers:      h,
+			IdleTimeout:   time.Minute,
+			IdleCloseCode: 4000,
+			Clock:         clock,
+		})
+		So(err, ShouldBeNil)
+		c, _, err := dialTestServer(srv, "token=123456", nil)
+		So(err, ShouldBeNil)
+		<-clock.timers // ping
+		idle := <-clock.timers
+		Convey("When client stays idle", func() {
+			idle.fire()
+			_, _, err := c.ReadMessage()
+			Convey("Then it should be closed with that code", func() {
+				So(websocket.IsCloseError(err, 4000), ShouldBeTrue)
+			})
+			Convey("Then 'OnOfflineReason' should receive the code and ErrIdleTimeout", func() {
+				So(<-h.reasons, ShouldResemble, OfflineReason{Code: 4000, Err: ErrIdleTimeout})
+			})
+		})
+		Reset(func() {
+			c.Close()
+		})
+	})
+}
+
+// fakeClock hands out timers that only fire when told to.
+type fakeClock struct {
+	timers chan *fakeTimer
+}
+
+func newFakeClock() fakeClock {
+	return fakeClock{timers: make(chan *fakeTimer, 10)}
+}
+
+func (c fakeClock) NewTimer(d time.Duration) Timer {
+	t := &fakeTimer{c: make(chan time.Time)}
+	c.timers <- t
+	return t
+}
+
+type fakeTimer struct {
+	c chan time.Time
+}
+
+// fire returns once the read loop has received the tick.
+func (t *fakeTimer) fire() {
+	t.c <- time.Now()
+}
+
+func (t *fakeTimer) C() <-chan time.Time        { return t.c }
+func (t *fakeTimer) Stop() bool                 { return true }
+func (t *fakeTimer) Reset(d time.Duration) bool { return true }
+
+func TestPingTimeout(t *testing.T) {
+	Convey("Given WS server with a fake clock", t, func() {
+		clock := newFakeClock()
+		srv, err := startTestServer(&Config{
+			Addr:     "localhost:0",
+			Handlers: THandlers{},
+			Clock:    clock,
+		})
+		So(err, ShouldBeNil)
+		c, _, err := dialTestServer(srv, "token=123456", nil)
+		So(err, ShouldBeNil)
+		ping := <-clock.timers
+		Convey("When the ping interval and then the pong timeout pass", func() {
+			// The ping handler doesn't answer, so no pong arrives.
+			pings := make(chan struct{}, 1)
+			c.SetPingHandler(func(string) error {
+				pings <- struct{}{}
+				return nil
+			})
+			readErr := make(chan error, 1)
+			go func() {
+				_, _, err := c.ReadMessage()
+				readErr <- err
+			}()
+			ping.fire()
+			<-pings
+			ping.fire()
+			Convey("Then client should be closed with 1002", func() {
+				So(websocket.IsCloseError(<-readErr, websocket.CloseProtocolError), ShouldBeTrue)
+			})
+		})
+		Reset(func() {
+			c.Close()
+		})
+	})
+}
+
+func TestOfflineReasonClean(t *testing.T) {
+	Convey("Given WS server reporting offline reasons", t, func() {
+		h := reasonHandlers{reasons: make(chan OfflineReason, 1)}
+		srv, err := startTestServer(&Config{
+			Addr:     "localhost:0",
+			Handlers: h,
+		})
+		So(err, ShouldBeNil)
+		c, _, err := dialTestServer(srv, "token=123456", nil)
+		So(err, ShouldBeNil)
+		Convey("When client closes normally", func() {
+			c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			Convey("Then the close should be clean", func() {
+				So((<-h.reasons).Clean(), ShouldBeTrue)
+			})
+		})
+		Convey("When client drops the connection", func() {
+			c.Close()
+			Convey("Then the close should not be clean", func() {
+				So((<-h.reasons).Clean(), ShouldBeFalse)
+			})
+		})
+		Convey("When client closes with an error code", func() {
+			c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseInternalServerErr, ""))
+			Convey("Then the close should not be clean", func() {
+				So((<-h.reasons).Clean(), ShouldBeFalse)
+			})
+		})
+		Reset(func() {
+			c.Close()
+		})
+	})
+}
+
+type recordTracer struct {
+	spans chan string
+}
+
+func (t recordTracer) StartSpan(name string, attrs map[string]interface{}) func(err error) {
+	return func(err error) {
+		t.spans <- name
+	}
+}
+
+func TestTracer(t *testing.T) {
+	Convey("Given WS server with a tracer", t, func() {
+		tr := recordTracer{spans: make(chan string, 10)}
+		srv, err := startTestServer(&Config{
+			Addr:     "localhost:0",
+			Handlers: tokenHandlers{},
+			Tracer:   tr,
+		})
+		So(err, ShouldBeNil)
+		c, _, err := dialTestServer(srv, "token=1", nil)
+		So(err, ShouldBeNil)
+		Convey("When client sends a message and is written to", func() {
+			So(receivedEvents(tr.spans, time.Millisecond*100), ShouldResemble, []string{SpanHandshake, SpanOnOnline})
+			c.WriteMessage(websocket.TextMessage, []byte("hello"))
+			So(<-tr.spans, ShouldEqual, SpanOnText)
+			So(srv.WriteMessage(1, []byte("hi")), ShouldBeNil)
+			Convey("Then every step should be traced", func() {
+				So(<-tr.spans, ShouldEqual, SpanWrite)
+			})
+		})
+		Reset(func() {
+			c.Close()
+		})
+	})
+}
+
+func TestPauseResume(t *testing.T) {
+	Convey("Given WS server with a connected client", t, func() {
+		h := orderHandlers{texts: make(chan string, 1)}
+		srv, err := startTestServer(&Config{
+			Addr:     "localhost:0",
+			Handlers: h,
+		})
+		So(err, ShouldBeNil)
+		c, _, err := dialTestServer(srv, "token=123456", nil)
+		So(err, ShouldBeNil)
+		time.Sleep(time.Millisecond * 300)
+		Convey("When reading is paused", func() {
+			// The read in flight at Pause still completes.
+			So(srv.Pause(1), ShouldBeNil)
+			c.WriteMessage(websocket.TextMessage, []byte("first"))
+			So(<-h.texts, ShouldEqual, "first")
+			c.WriteMessage(websocket.TextMessage, []byte("second"))
+			Convey("Then messages should not be delivered until resumed", func() {
+				select {
+				case <-h.texts:
+					So("delivered while paused", ShouldBeEmpty)
+				case <-time.After(time.Millisecond * 300):
+				}
+				So(srv.Resume(1), ShouldBeNil)
+				So(<-h.texts, ShouldEqual, "second")
+			})
+		})
+		Reset(func() {
+			c.Close()
+		})
+	})
+}
+
+func TestOnTextWorkers(t *testing.T) {
+	Convey("Given WS server with an OnText worker pool", t, func() {
+		h := orderHandlers{texts: make(chan string, 10)}
+		srv, err := startTestServer(&Config{
+			Addr:          "localhost:0",
+			Handlers:      h,
+			OnTextWorkers: 2,
+		})
+		So(err, ShouldBeNil)
+		c, _, err := dialTestServer(srv, "token=123456", nil)
+		So(err, ShouldBeNil)
+		Convey("When client sends messages", func() {
+			for i := 0; i < 10; i++ {
+				c.WriteMessage(websocket.TextMessage, []byte(strconv.Itoa(i)))
+			}
+			Convey("Then all of them should be delivered to 'OnText'", func() {
+				got := make([]string, 0)
+				for i := 0; i < 10; i++ {
+					got = append(got, <-h.texts)
+				}
+				So(got, ShouldHaveLength, 10)
+			})
+		})
+		Reset(func() {
+			c.Close()
+		})
+	})
+	Convey("Given WS server with an OnText worker busy in 'OnText'", t, func() {
+		h := orderHandlers{texts: make(chan string)}
+		srv, err := startTestServer(&Config{
+			Addr:          "localhost:0",
+			Handlers:      h,
+			OnTextWorkers: 1,
+		})
+		So(err, ShouldBeNil)
+		c, _, err := dialTestServer(srv, "token=123456", nil)
+		So(err, ShouldBeNil)
+		c.WriteMessage(websocket.TextMessage, []byte("busy"))
+		time.Sleep(time.Millisecond * 100)
+		Convey("When the server shuts down", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+			defer cancel()
+			err := srv.Shutdown(ctx)
+			Convey("Then it should wait for the worker", func() {
+				So(err == context.DeadlineExceeded, ShouldBeTrue)
+			})
+			Convey("Then it should return once the worker has", func() {
+				So(<-h.texts, ShouldEqual, "busy")
+				So(srv.Shutdown(context.Background()), ShouldBeNil)
+			})
+		})
+		Reset(func() {
+			c.Close()
+		})
+	})
+}
+
+func TestCloseAll(t *testing.T) {
+	Convey("Given WS server with a connected client", t, func() {
+		srv, err := startTestServer(&Config{
+			Addr:     "localhost:0",
+			Handlers: THandlers{},
+		})
+		So(err, ShouldBeNil)
+		c, _, err := dialTestServer(srv, "token=123456", nil)
+		So(err, ShouldBeNil)
+		time.Sleep(time.Millisecond * 300)
+		Convey("When server closes all connections with a per-id code", func() {
+			srv.CloseAll(func(id uint) (ws.StatusCode, string) {
+				return ws.StatusGoingAway, "restart"
+			})
+			Convey("Then client should receive that code and reason", func() {
+				_, _, err := c.ReadMessage()
+				So(websocket.IsCloseError(err, int(ws.StatusGoingAway)), ShouldBeTrue)
+				So(err.(*websocket.CloseError).Text, ShouldEqual, "restart")
+			})
+		})
+		Reset(func() {
+			c.Close()
+		})
+	})
+}
+
+func TestCloseWhere(t *testing.T) {
+	Convey("Given WS server with clients on two paths", t, func() {
+		srv, err := startTestServer(&Config{
+			Addr:     "localhost:0",
+			Handlers: tokenHandlers{},
+		})
+		So(err, ShouldBeNil)
+		c1, _, err := websocket.DefaultDialer.Dial("ws://"+srv.addr+"/tenant/a?token=1", nil)
+		So(err, ShouldBeNil)
+		c2, _, err := websocket.DefaultDialer.Dial("ws://"+srv.addr+"/tenant/b?token=2", nil)
+		So(err, ShouldBeNil)
+		time.Sleep(time.Millisecond * 100)
+		Convey("When server closes the connections of one tenant", func() {
+			closed := srv.CloseWhere(func(info ConnInfo) bool {
+				return info.Request.Path == "/tenant/a"
+			}, ws.StatusPolicyViolation, "evicted")
+			Convey("Then only those should be closed", func() {
+				So(closed, ShouldEqual, 1)
+				_, _, err := c1.ReadMessage()
+				So(websocket.IsCloseError(err, websocket.ClosePolicyViolation), ShouldBeTrue)
+				So(srv.WriteMessage(2, []byte("still here")), ShouldBeNil)
+				_, msg, err := c2.ReadMessage()
+				So(err, ShouldBeNil)
+				So(string(msg), ShouldEqual, "still here")
+			})
+		})
+		Reset(func() {
+			c1.Close()
+			c2.Close()
+		})
+	})
+}
+
+func TestOversizedControlFrame(t *testing.T) {
+	Convey("Given WS server", t, func() {
+		srv, err := startTestServer(&Config{
+			Addr:     "localhost:0",
+			Handlers: THandlers{},
+		})
+		So(err, ShouldBeNil)
+		Convey("When client sends a ping larger than 125 bytes", func() {
+			conn, _, _, err := ws.Dial(context.Background(), "ws://"+srv.addr+"/?token=123456")
+			So(err, ShouldBeNil)
+			f := ws.MaskFrameInPlace(ws.NewPingFrame(make([]byte, 126)))
+			So(ws.WriteFrame(conn, f), ShouldBeNil)
+			Convey("Then server should close with a protocol error", func() {
+				f, err := ws.ReadFrame(conn)
+				So(err, ShouldBeNil)
+				So(f.Header.OpCode, ShouldEqual, ws.OpClose)
+				code, _ := ws.ParseCloseFrameData(f.Payload)
+				So(code, ShouldEqual, ws.StatusProtocolError)
+			})
+			Reset(func() {
+				conn.Close()
+			})
+		})
+	})
+}
+
+func TestConnState(t *testing.T) {
+	Convey("Given WS server gating messages until an init frame", t, func() {
+		h := orderHandlers{texts: make(chan string, 10)}
+		srv, err := startTestServer(&Config{
+			Addr:            "localhost:0",
+			Handlers:        h,
+			OrderedDelivery: true,
+			InitialState:    StateUpgraded,
+			AcceptText: func(id uint, state ConnState, msg []byte) bool {
+				return state == StateReady || string(msg) == "init"
+			},
+		})
+		So(err, ShouldBeNil)
+		c, _, err := dialTestServer(srv, "token=123456", nil)
+		So(err, ShouldBeNil)
+		time.Sleep(time.Millisecond * 300)
+		Convey("When client sends messages before and after the init frame", func() {
+			c.WriteMessage(websocket.TextMessage, []byte("early"))
+			c.WriteMessage(websocket.TextMessage, []byte("init"))
+			So(<-h.texts, ShouldEqual, "init")
+			So(srv.SetState(1, StateReady), ShouldBeNil)
+			c.WriteMessage(websocket.TextMessage, []byte("hello"))
+			Convey("Then only messages accepted in the current state should be delivered", func() {
+				So(<-h.texts, ShouldEqual, "hello")
+				state, err := srv.State(1)
+				So(err, ShouldBeNil)
+				So(state, ShouldEqual, StateReady)
+			})
+		})
+		Reset(func() {
+			c.Close()
+		})
+	})
+}
+
+func TestOnReceive(t *testing.T) {
+	Convey("Given WS server rewriting inbound messages", t, func() {
+		h := orderHandlers{texts: make(chan string, 10)}
+		srv, err := startTestServer(&Config{
+			Addr:            "localhost:0",
+			Handlers:        h,
+			OrderedDelivery: true,
+			OnReceive: func(id uint, msg []byte) ([]byte, bool) {
+				return bytes.ToUpper(msg), string(msg) != "drop"
+			},
+		})
+		So(err, ShouldBeNil)
+		c, _, err := dialTestServer(srv, "token=123456", nil)
+		So(err, ShouldBeNil)
+		Convey("When client sends a dropped and a kept message", func() {
+			c.WriteMessage(websocket.TextMessage, []byte("drop"))
+			c.WriteMessage(websocket.TextMessage, []byte("keep"))
+			Convey("Then 'OnText' should only receive the rewritten kept one", func() {
+				So(<-h.texts, ShouldEqual, "KEEP")
+				So(len(h.texts), ShouldEqual, 0)
+			})
+		})
+		Reset(func() {
+			c.Close()
+		})
+	})
+}
+
+func TestEvents(t *testing.T) {
+	Convey("Given WS server with an event buffer of 2", t, func() {
+		srv, err := startTestServer(&Config{
+			Addr:        "localhost:0",
+			Handlers:    &THandlers{},
+			EventBuffer: 2,
+		})
+		So(err, ShouldBeNil)
+		c, _, err := dialTestServer(srv, "token=123456", nil)
+		So(err, ShouldBeNil)
+		Convey("When client sends a message and disconnects", func() {
+			So((<-srv.Events()).Type, ShouldEqual, EventOnline)
+			c.WriteMessage(websocket.TextMessage, []byte("hello"))
+			e := <-srv.Events()
+			c.Close()
+			Convey("Then the text and offline events should be sent in order", func() {
+				So(e.Type, ShouldEqual, EventText)
+				So(string(e.Payload), ShouldEqual, "hello")
+				So((<-srv.Events()).Type, ShouldEqual, EventOffline)
+			})
+		})
+		Convey("When the consumer falls behind", func() {
+			for i := 0; i < 3; i++ {
+				c.WriteMessage(websocket.TextMessage, []byte("hello"))
+			}
+			time.Sleep(time.Millisecond * 200)
+			Convey("Then the overflowing events should be dropped", func() {
+				So(len(srv.Events()), ShouldEqual, 2)
+				So(srv.Diagnostics().Dropped, ShouldEqual, 2)
+			})
+		})
+		Reset(func() {
+			c.Close()
+		})
+	})
+}
+
+func TestDuplicatePolicyRejectNew(t *testing.T) {
+	Convey("Given WS server rejecting duplicate connections", t, func() {
+		h := lifecycleHandlers{events: make(chan string, 10)}
+		srv, err := startTestServer(&Config{
+			Addr:            "localhost:0",
+			Handlers:        h,
+			DuplicatePolicy: RejectNew,
+		})
+		So(err, ShouldBeNil)
+		c, _, err := dialTestServer(srv, "token=123456", nil)
+		So(err, ShouldBeNil)
+		So(<-h.events, ShouldEqual, onOnline)
+		Convey("When the same id connects again", func() {
+			c2, _, err := dialTestServer(srv, "token=123456", nil)
+			So(err, ShouldBeNil)
+			Convey("Then the new connection should be closed with 1008", func() {
+				_, _, err := c2.ReadMessage()
+				So(websocket.IsCloseError(err, websocket.ClosePolicyViolation), ShouldBeTrue)
+			})
+			Convey("Then the existing connection should stay online", func() {
+				So(receivedEvents(h.events, time.Millisecond*300), ShouldBeEmpty)
+			})
+			Reset(func() {
+				c2.Close()
+			})
+		})
+		Reset(func() {
+			c.Close()
+		})
+	})
+}
+
+func TestBan(t *testing.T) {
+	Convey("Given WS server with a banned id", t, func() {
+		srv, err := startTestServer(&Config{
+			Addr:     "localhost:0",
+			Handlers: tokenHandlers{},
+		})
+		So(err, ShouldBeNil)
+		srv.Ban(1, time.Now().Add(time.Hour))
+		srv.Ban(2, time.Now().Add(-time.Second))
+		Convey("When the banned id connects", func() {
+			c, _, err := dialTestServer(srv, "token=1", nil)
+			So(err, ShouldBeNil)
+			Convey("Then it should be closed with 1008", func() {
+				_, _, err := c.ReadMessage()
+				So(websocket.IsCloseError(err, websocket.ClosePolicyViolation), ShouldBeTrue)
+			})
+			Reset(func() {
+				c.Close()
+			})
+		})
+		Convey("When an id whose ban expired or was lifted connects", func() {
+			srv.Unban(1)
+			c1, _, err := dialTestServer(srv, "token=1", nil)
+			So(err, ShouldBeNil)
+			c2, _, err := dialTestServer(srv, "token=2", nil)
+			So(err, ShouldBeNil)
+			time.Sleep(time.Millisecond * 100)
+			Convey("Then it should stay connected", func() {
+				So(srv.WriteMessage(1, []byte("a")), ShouldBeNil)
+				So(srv.WriteMessage(2, []byte("b")), ShouldBeNil)
+			})
+			Reset(func() {
+				c1.Close()
+				c2.Close()
+			})
+		})
+	})
+}
+
+func TestRebind(t *testing.T) {
+	Convey("Given WS server with two clients", t, func() {
+		rebound := make(chan [2]uint, 1)
+		srv, err := startTestServer(&Config{
+			Addr:     "localhost:0",
+			Handlers: tokenHandlers{},
+			OnRebind: func(oldID, newID uint) {
+				rebound <- [2]uint{oldID, newID}
+			},
+		})
+		So(err, ShouldBeNil)
+		c1, _, err := dialTestServer(srv, "token=1", nil)
+		So(err, ShouldBeNil)
+		c2, _, err := dialTestServer(srv, "token=2", nil)
+		So(err, ShouldBeNil)
+		time.Sleep(time.Millisecond * 300)
+		Convey("Rebind to a connected id should fail", func() {
+			So(srv.Rebind(1, 2), ShouldEqual, ErrIDInUse)
+		})
+		Convey("Rebind of an unknown id should fail", func() {
+			So(srv.Rebind(5, 3), ShouldEqual, ErrConnNotFound)
+		})
+		Convey("Rebind to id 0 should fail", func() {
+			So(srv.Rebind(1, 0), ShouldEqual, ErrZeroID)
+		})
+		Convey("Rebind to a banned id should fail", func() {
+			srv.Ban(3, time.Now().Add(time.Minute))
+			So(srv.Rebind(1, 3), ShouldEqual, ErrIDBanned)
+			srv.WriteMessage(1, []byte("still 1"))
+			_, msg, err := c1.ReadMessage()
+			So(err, ShouldBeNil)
+			So(string(msg), ShouldEqual, "still 1")
+		})
+		Convey("When client 1 is rebound to 3", func() {
+			So(srv.Rebind(1, 3), ShouldBeNil)
+			Convey("Then OnRebind should be called", func() {
+				So(<-rebound, ShouldResemble, [2]uint{1, 3})
+			})
+			Convey("Then messages to 3 should reach it", func() {
+				So(srv.WriteMessage(1, []byte("x")), ShouldEqual, ErrConnNotFound)
+				So(srv.WriteMessage(3, []byte("hello")), ShouldBeNil)
+				_, msg, err := c1.ReadMessage()
+				So(err, ShouldBeNil)
+				So(string(msg), ShouldEqual, "hello")
+			})
+		})
+		Reset(func() {
+			c1.Close()
+			c2.Close()
+		})
+	})
+}
+
+func TestStats(t *testing.T) {
+	Convey("Given WS server with a connected client", t, func() {
+		srv, err := startTestServer(&Config{
+			Addr:     "localhost:0",
+			Handlers: tokenHandlers{},
+		})
+		So(err, ShouldBeNil)
+		c, _, err := dialTestServer(srv, "token=1", nil)
+		So(err, ShouldBeNil)
+		time.Sleep(time.Millisecond * 100)
+		Convey("When frames are exchanged and the client closes", func() {
+			So(c.WriteMessage(websocket.TextMessage, []byte("hello")), ShouldBeNil)
+			So(c.WriteMessage(websocket.PingMessage, nil), ShouldBeNil)
+			So(srv.WriteMessage(1, []byte("hi")), ShouldBeNil)
+			So(c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")), ShouldBeNil)
+			time.Sleep(time.Millisecond * 300)
+			Convey("Then stats should count them by opcode", func() {
+				st := srv.Stats()
+				So(st.Received, ShouldResemble, FrameCounts{Text: 1, Ping: 1, Close: 1})
+				So(st.Sent, ShouldResemble, FrameCounts{Text: 1, Pong: 1, Close: 1})
+			})
+		})
+		Reset(func() {
+			c.Close()
+		})
+	})
+}
+
+func TestWriteStream(t *testing.T) {
+	Convey("Given WS server with a connected client", t, func() {
+		srv, err := startTestServer(&Config{
+			Addr:     "localhost:0",
+			Handlers: tokenHandlers{},
+		})
+		So(err, ShouldBeNil)
+		c, _, err := dialTestServer(srv, "token=1", nil)
+		So(err, ShouldBeNil)
+		time.Sleep(time.Millisecond * 100)
+		Convey("When a large payload is streamed to it", func() {
+			payload := strings.Repeat("0123456789", 10000)
+			So(srv.WriteStream(1, ws.OpText, strings.NewReader(payload)), ShouldBeNil)
+			Convey("Then the client should receive it as one message", func() {
+				typ, msg, err := c.ReadMessage()
+				So(err, ShouldBeNil)
+				So(typ, ShouldEqual, websocket.TextMessage)
+				So(string(msg), ShouldEqual, payload)
+			})
+		})
+		Convey("Streaming to an unknown id should fail", func() {
+			So(srv.WriteStream(5, ws.OpText, strings.NewReader("x")), ShouldEqual, ErrConnNotFound)
+		})
+		Reset(func() {
+			c.Close()
+		})
+	})
+}
+
+func TestMaxFrameSize(t *testing.T) {
+	Convey("Given WS server fragmenting messages into 1000 byte frames", t, func() {
+		srv, err := startTestServer(&Config{
+			Addr:         "localhost:0",
+			Handlers:     tokenHandlers{},
+			MaxFrameSize: 1000,
+		})
+		So(err, ShouldBeNil)
+		conn, _, _, err := ws.Dial(context.Background(), "ws://"+srv.addr+"/?token=1")
+		So(err, ShouldBeNil)
+		time.Sleep(time.Millisecond * 100)
+		Convey("When a 2500 byte message is written", func() {
+			So(srv.WriteMessage(1, bytes.Repeat([]byte("x"), 2500)), ShouldBeNil)
+			Convey("Then the client should receive it in three frames", func() {
+				var frames []ws.Frame
+				for len(frames) == 0 || !frames[len(frames)-1].Header.Fin {
+					f, err := ws.ReadFrame(conn)
+					So(err, ShouldBeNil)
+					frames = append(frames, f)
+				}
+				So(len(frames), ShouldEqual, 3)
+				So(frames[0].Header.OpCode, ShouldEqual, ws.OpText)
+				So(frames[1].Header.OpCode, ShouldEqual, ws.OpContinuation)
+				So(len(frames[0].Payload), ShouldEqual, 1000)
+				So(len(frames[2].Payload), ShouldEqual, 500)
+			})
+		})
+		Reset(func() {
+			conn.Close()
+		})
+	})
+	Convey("Given WS server fragmenting messages to a client that pinged", t, func() {
+		srv, err := New(&Config{
+			Handlers:     tokenHandlers{},
+			MaxFrameSize: 1000,
+		})
+		So(err, ShouldBeNil)
+		// net.Pipe is unbuffered, so each frame is written once read.
+		server, client := net.Pipe()
+		go srv.HandleConn(server)
+		d := ws.Dialer{
+			NetDial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return client, nil
+			},
+		}
+		conn, _, _, err := d.Dial(context.Background(), "ws://pipe/?token=1")
+		So(err, ShouldBeNil)
+		time.Sleep(time.Millisecond * 100)
+		Convey("When the ping arrives while a message is written", func() {
+			go srv.WriteMessage(1, bytes.Repeat([]byte("x"), 2500))
+			time.Sleep(time.Millisecond * 100)
+			So(ws.WriteFrame(conn, ws.MaskFrameInPlace(ws.NewPingFrame([]byte("p")))), ShouldBeNil)
+			time.Sleep(time.Millisecond * 100)
+			Convey("Then the pong should go out between its frames", func() {
+				var ops []ws.OpCode
+				for len(ops) < 4 {
+					f, err := ws.ReadFrame(conn)
+					So(err, ShouldBeNil)
+					ops = append(ops, f.Header.OpCode)
+				}
+				So(ops[0], ShouldEqual, ws.OpText)
+				So(ops[1:3], ShouldContain, ws.OpPong)
+				So(ops[3], ShouldEqual, ws.OpContinuation)
+			})
+		})
+		Reset(func() {
+			conn.Close()
+		})
+	})
+}
+
+func TestFuncHandlers(t *testing.T) {
+	Convey("Given WS server configured with function shortcuts", t, func() {
+		texts := make(chan string, 1)
+		srv, err := startTestServer(&Config{
+			Addr: "localhost:0",
+			AuthFunc: func(token string) (uint, bool) {
+				return 1, token == "123456"
+			},
+			TextFunc: func(id uint, msg []byte) {
+				texts <- string(msg)
+			},
+		})
+		So(err, ShouldBeNil)
+		c, _, err := dialTestServer(srv, "token=123456", nil)
+		So(err, ShouldBeNil)
+		Convey("When client sends a message", func() {
+			c.WriteMessage(websocket.TextMessage, []byte("hello"))
+			Convey("Then TextFunc should receive it", func() {
+				So(<-texts, ShouldEqual, "hello")
+			})
+		})
+		Convey("A wrong token should be rejected", func() {
+			_, _, err := dialTestServer(srv, "token=1", nil)
+			So(err, ShouldNotBeNil)
+		})
+		Reset(func() {
+			c.Close()
+		})
+	})
+	Convey("A config without Handlers nor AuthFunc should be refused", t, func() {
+		_, err := New(&Config{})
+		So(err, ShouldEqual, ErrNoHandlers)
+	})
+}
+
+func TestDecoupleOnline(t *testing.T) {
+	for _, decouple := range []bool{false, true} {
+		Convey("Given WS server with a slow OnOnline, DecoupleOnline "+strconv.FormatBool(decouple), t, func() {
+			release := make(chan struct{})
+			offline := make(chan struct{}, 1)
+			srv, err := startTestServer(&Config{
+				Addr:           "localhost:0",
+				DecoupleOnline: decouple,
+				AuthFunc: func(token string) (uint, bool) {
+					return 1, true
+				},
+				OnlineFunc: func(id uint) {
+					<-release
+				},
+				OfflineFunc: func(id uint) {
+					offline <- struct{}{}
+				},
+			})
+			So(err, ShouldBeNil)
+			Convey("When client disconnects while OnOnline runs", func() {
+				c, _, err := dialTestServer(srv, "token=1", nil)
+				So(err, ShouldBeNil)
+				c.Close()
+				if decouple {
+					Convey("Then OnOffline should not wait for OnOnline", func() {
+						So(receivedBefore(offline, time.Second), ShouldBeTrue)
+						close(release)
+					})
+				} else {
+					Convey("Then OnOffline should follow OnOnline", func() {
+						So(receivedBefore(offline, 100*time.Millisecond), ShouldBeFalse)
+						close(release)
+						So(receivedBefore(offline, time.Second), ShouldBeTrue)
+					})
+				}
+			})
+		})
+	}
+}
+
+func receivedBefore(ch chan struct{}, d time.Duration) bool {
+	select {
+	case <-ch:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+
+type chatMessage struct {
+	Text string `json:"text"`
+}
+
+type valueHandlers struct {
+	THandlers
+	values chan *chatMessage
+}
+
+func (h valueHandlers) NewValue(id uint) interface{} {
+	return &chatMessage{}
+}
+
+func (h valueHandlers) OnValue(id uint, v interface{}) {
+	h.values <- v.(*chatMessage)
+}
+
+func TestCodec(t *testing.T) {
+	Convey("Given WS server with a JSON codec", t, func() {
+		h := valueHandlers{values: make(chan *chatMessage, 1)}
+		srv, err := startTestServer(&Config{
+			Addr:     "localhost:0",
+			Handlers: h,
+			Codec:    JSONCodec{},
+		})
+		So(err, ShouldBeNil)
+		c, _, err := dialTestServer(srv, "token=123456", nil)
+		So(err, ShouldBeNil)
+		Convey("When client sends a JSON message", func() {
+			So(c.WriteMessage(websocket.TextMessage, []byte(`{"text":"hello"}`)), ShouldBeNil)
+			Convey("Then 'OnValue' should receive it decoded", func() {
+				So(<-h.values, ShouldResemble, &chatMessage{Text: "hello"})
+			})
+		})
+		Convey("When client sends a message that doesn't decode", func() {
+			So(c.WriteMessage(websocket.TextMessage, []byte(`hello`)), ShouldBeNil)
+			Convey("Then it should be dropped", func() {
+				var got *chatMessage
+				select {
+				case got = <-h.values:
+				case <-time.After(100 * time.Millisecond):
+				}
+				So(got, ShouldBeNil)
+			})
+		})
+		Convey("When server sends a value", func() {
+			So(srv.SendCodec(1, chatMessage{Text: "hi"}), ShouldBeNil)
+			Convey("Then client should receive it encoded", func() {
+				_, msg, err := c.ReadMessage()
+				So(err, ShouldBeNil)
+				So(string(msg), ShouldEqual, `{"text":"hi"}`)
+			})
+		})
+		Reset(func() {
+			c.Close()
+		})
+	})
+	Convey("Given WS server with the default codec", t, func() {
+		srv, err := startTestServer(&Config{
+			Addr:     "localhost:0",
+			Handlers: THandlers{},
+		})
+		So(err, ShouldBeNil)
+		c, _, err := dialTestServer(srv, "token=123456", nil)
+		So(err, ShouldBeNil)
+		Convey("Then strings should be sent as is", func() {
+			So(srv.SendCodec(1, "hi"), ShouldBeNil)
+			_, msg, err := c.ReadMessage()
+			So(err, ShouldBeNil)
+			So(string(msg), ShouldEqual, "hi")
+		})
+		Convey("Then other values should be refused", func() {
+			So(srv.SendCodec(1, 42), ShouldEqual, ErrCodecType)
+		})
+		Reset(func() {
+			c.Close()
+		})
+	})
+}
+
+func TestMaxInFlight(t *testing.T) {
+	Convey("Given WS server with a window of 2 unacked messages", t, func() {
+		srv, err := startTestServer(&Config{
+			Addr:        "localhost:0",
+			Handlers:    tokenHandlers{},
+			MaxInFlight: 2,
+		})
+		So(err, ShouldBeNil)
+		c, _, err := dialTestServer(srv, "token=1", nil)
+		So(err, ShouldBeNil)
+		So(srv.WriteAcked(1, []byte("one")), ShouldBeNil)
+		So(srv.WriteAcked(1, []byte("two")), ShouldBeNil)
+		Convey("When the window is full", func() {
+			Convey("Then further messages should be refused", func() {
+				So(srv.WriteAcked(1, []byte("three")), ShouldEqual, ErrWindowFull)
+			})
+			Convey("Then an ack should free a slot", func() {
+				So(srv.Ack(1, 1), ShouldBeNil)
+				So(srv.WriteAcked(1, []byte("three")), ShouldBeNil)
+				So(srv.WriteAcked(1, []byte("four")), ShouldEqual, ErrWindowFull)
+			})
+			Convey("Then extra acks should not widen the window", func() {
+				So(srv.Ack(1, 5), ShouldBeNil)
+				So(srv.WriteAcked(1, []byte("three")), ShouldBeNil)
+				So(srv.WriteAcked(1, []byte("four")), ShouldBeNil)
+				So(srv.WriteAcked(1, []byte("five")), ShouldEqual, ErrWindowFull)
+			})
+		})
+		Convey("Other writes should not take slots", func() {
+			So(srv.WriteMessage(1, []byte("three")), ShouldBeNil)
+			So(srv.Ack(1, 1), ShouldBeNil)
+			So(srv.WriteAcked(1, []byte("four")), ShouldBeNil)
+		})
+		Convey("Acking an unknown id should fail", func() {
+			So(srv.Ack(2, 1), ShouldEqual, ErrConnNotFound)
+		})
+		Reset(func() {
+			c.Close()
+		})
+	})
+}
+
+func TestMaxInFlightBatch(t *testing.T) {
+	Convey("Given WS server batching a window of 1 unacked message", t, func() {
+		srv, err := New(&Config{
+			Handlers:       tokenHandlers{},
+			MaxInFlight:    1,
+			CoalesceWindow: 20 * time.Millisecond,
+		})
+		So(err, ShouldBeNil)
+		fc := &failingConn{}
+		c, err := pipeDial(srv, func(conn net.Conn) net.Conn {
+			fc.Conn = conn
+			return fc
+		}, "token=1")
+		So(err, ShouldBeNil)
+		time.Sleep(time.Millisecond * 100)
+		Convey("When the batch of a message fails to be written", func() {
+			atomic.StoreInt32(&fc.fail, 1)
+			So(srv.WriteAcked(1, []byte("one")), ShouldBeNil)
+			time.Sleep(time.Millisecond * 100)
+			Convey("Then its slot should be freed", func() {
+				So(srv.WriteAcked(1, []byte("two")), ShouldBeNil)
+			})
+		})
+		Reset(func() {
+			c.Close()
+		})
+	})
+}
+
+func TestWriteControl(t *testing.T) {
+	Convey("Given WS server with a connected client", t, func() {
+		srv, err := startTestServer(&Config{
+			Addr:     "localhost:0",
+			Handlers: tokenHandlers{},
+		})
+		So(err, ShouldBeNil)
+		c, _, err := dialTestServer(srv, "token=1", nil)
+		So(err, ShouldBeNil)
+		time.Sleep(time.Millisecond * 100)
+		Convey("When server sends a ping with a payload", func() {
+			pings := make(chan string, 1)
+			c.SetPingHandler(func(data string) error {
+				pings <- data
+				return nil
+			})
+			go c.ReadMessage()
+			So(srv.WriteControl(1, ws.OpPing, []byte("beat 7")), ShouldBeNil)
+			Convey("Then client should receive the payload", func() {
+				So(<-pings, ShouldEqual, "beat 7")
+			})
+		})
+		Convey("When server sends a close with an application reason", func() {
+			So(srv.WriteControl(1, ws.OpClose, ws.NewCloseFrameBody(4001, "kicked")), ShouldBeNil)
+			Convey("Then client should receive that code and reason", func() {
+				_, _, err := c.ReadMessage()
+				So(websocket.IsCloseError(err, 4001), ShouldBeTrue)
+				So(err.(*websocket.CloseError).Text, ShouldEqual, "kicked")
+			})
+		})
+		Convey("Data frames and large payloads should be refused", func() {
+			So(srv.WriteControl(1, ws.OpText, nil), ShouldEqual, ErrNotControl)
+			So(srv.WriteControl(1, ws.OpPing, make([]byte, 126)), ShouldEqual, ErrControlSize)
+		})
+		Reset(func() {
+			c.Close()
+		})
+	})
+}
+
+func TestRelisten(t *testing.T) {
+	Convey("Given WS server with a connected client", t, func() {
+		srv, err := startTestServer(&Config{
+			Addr:     "localhost:0",
+			Handlers: tokenHandlers{},
+		})
+		So(err, ShouldBeNil)
+		c, _, err := dialTestServer(srv, "token=1", nil)
+		So(err, ShouldBeNil)
+		oldAddr := srv.addr
+		Convey("When the server relistens on a new listener", func() {
+			ln, err := net.Listen("tcp", "localhost:0")
+			So(err, ShouldBeNil)
+			So(srv.Relisten(ln), ShouldBeNil)
+			Convey("Then new clients should connect to it", func() {
+				c2, _, err := dialTestServer(srv, "token=2", nil)
+				So(err, ShouldBeNil)
+				c2.Close()
+			})
+			Convey("Then the old listener should be closed", func() {
+				_, err := net.Dial("tcp", oldAddr)
+				So(err, ShouldNotBeNil)
+			})
+			Convey("Then the existing client should stay connected", func() {
+				So(srv.WriteMessage(1, []byte("hello")), ShouldBeNil)
+				_, msg, err := c.ReadMessage()
+				So(err, ShouldBeNil)
+				So(string(msg), ShouldEqual, "hello")
+			})
+		})
+		Reset(func() {
+			c.Close()
+		})
+	})
+}
+
+// logLines sends every line written to it, as a log.Logger output.
+type logLines chan string
+
+func (l logLines) Write(p []byte) (int, error) {
+	select {
+	case l <- strings.TrimSpace(string(p)):
+	default:
+	}
+	return len(p), nil
+}
+
+func TestListenerClose(t *testing.T) {
+	Convey("Given WS server logging to a channel", t, func() {
+		lines := make(logLines, 10)
+		srv, err := New(&Config{
+			Handlers: THandlers{},
+			Logger:   log.New(lines, "", 0),
+		})
+		So(err, ShouldBeNil)
+		ln, err := net.Listen("tcp", "localhost:0")
+		So(err, ShouldBeNil)
+		So(srv.Relisten(ln), ShouldBeNil)
+		<-lines
+		Convey("When Shutdown closes the listener", func() {
+			So(srv.Shutdown(context.Background()), ShouldBeNil)
+			Convey("Then accepting should stop silently", func() {
+				So(receivedEvents(lines, 200*time.Millisecond), ShouldBeEmpty)
+			})
+		})
+		Convey("When the listener is closed by its owner", func() {
+			ln.Close()
+			Convey("Then accepting should stop with a single line", func() {
+				got := receivedEvents(lines, 200*time.Millisecond)
+				So(got, ShouldHaveLength, 1)
+				So(got[0], ShouldContainSubstring, "stopped accepting")
+			})
+		})
+	})
+}
+
+func TestLogPayloads(t *testing.T) {
+	for _, logPayloads := range []bool{true, false} {
+		Convey("Given echo WS server with LogPayloads "+strconv.FormatBool(logPayloads), t, func() {
+			lines := make(logLines, 10)
+			srv, err := startTestServer(&Config{
+				Addr:        "localhost:0",
+				Handlers:    &EchoHandlers{},
+				Logger:      log.New(lines, "", 0),
+				LogPayloads: logPayloads,
+				RedactFunc: func(p []byte) []byte {
+					return bytes.Replace(p, []byte("secret"), []byte("***"), -1)
+				},
+			})
+			So(err, ShouldBeNil)
+			c, _, err := dialTestServer(srv, "token=any", nil)
+			So(err, ShouldBeNil)
+			Convey("When client sends a message with a secret", func() {
+				So(c.WriteMessage(websocket.TextMessage, []byte("pass=secret")), ShouldBeNil)
+				_, _, err := c.ReadMessage()
+				So(err, ShouldBeNil)
+				var payloads []string
+				for _, l := range receivedEvents(lines, 100*time.Millisecond) {
+					So(l, ShouldNotContainSubstring, "secret")
+					if strings.Contains(l, "pass=") {
+						payloads = append(payloads, l)
+					}
+				}
+				if logPayloads {
+					Convey("Then both directions should be logged redacted", func() {
+						So(payloads, ShouldHaveLength, 2)
+						So(payloads[0], ShouldContainSubstring, `Received: "pass=***"`)
+						So(payloads[1], ShouldContainSubstring, `Sending: "pass=***"`)
+					})
+				} else {
+					Convey("Then no payload should be logged", func() {
+						So(payloads, ShouldBeEmpty)
+					})
+				}
+			})
+			Reset(func() {
+				c.Close()
+			})
+		})
+	}
+}
+
+func TestLogPayloadsRedactInPlace(t *testing.T) {
+	Convey("Given echo WS server retrying writes and redacting payloads in place", t, func() {
+		lines := make(logLines, 10)
+		srv, err := New(&Config{
+			Handlers:     &EchoHandlers{},
+			Logger:       log.New(lines, "", 0),
+			WriteRetries: 2,
+			LogPayloads:  true,
+			RedactFunc: func(p []byte) []byte {
+				if i := bytes.Index(p, []byte("secret")); i >= 0 {
+					copy(p[i:], "******")
+				}
+				return p
+			},
+		})
+		So(err, ShouldBeNil)
+		fc := &flakyConn{}
+		c, err := pipeDial(srv, func(conn net.Conn) net.Conn {
+			fc.Conn = conn
+			return fc
+		}, "token=any")
+		So(err, ShouldBeNil)
+		time.Sleep(time.Millisecond * 100)
+		Convey("When client sends a secret echoed after two failed writes", func() {
+			fc.err = tempErr{}
+			atomic.StoreInt32(&fc.fails, 2)
+			So(c.WriteMessage(websocket.TextMessage, []byte("pass=secret")), ShouldBeNil)
+			_, msg, err := c.ReadMessage()
+			So(err, ShouldBeNil)
+			Convey("Then the echo should be unchanged", func() {
+				So(string(msg), ShouldEqual, "pass=secret")
+			})
+			Convey("Then each direction should be logged redacted once", func() {
+				var payloads []string
+				for _, l := range receivedEvents(lines, 100*time.Millisecond) {
+					if strings.Contains(l, "pass=") {
+						payloads = append(payloads, l)
+					}
+				}
+				So(payloads, ShouldHaveLength, 2)
+				So(payloads[0], ShouldContainSubstring, `Received: "pass=******"`)
+				So(payloads[1], ShouldContainSubstring, `Sending: "pass=******"`)
+			})
+		})
+		Reset(func() {
+			c.Close()
+		})
+	})
+}
+
+// tokenLifecycleHandlers are lifecycleHandlers authenticating like
+// tokenHandlers.
+type tokenLifecycleHandlers struct {
+	lifecycleHandlers
+}
+
+func (h tokenLifecycleHandlers) OnAuth(token string) (id uint, ok bool) {
+	return tokenHandlers{}.OnAuth(token)
+}
+
+func TestMaxOpenConns(t *testing.T) {
+	Convey("Given WS server accepting one connection at a time", t, func() {
+		srv, err := startTestServer(&Config{
+			Addr:         "localhost:0",
+			Handlers:     tokenHandlers{},
+			MaxOpenConns: 1,
+		})
+		So(err, ShouldBeNil)
+		c, _, err := dialTestServer(srv, "token=1", nil)
+		So(err, ShouldBeNil)
+		Convey("When a second client connects", func() {
+			d := websocket.Dialer{HandshakeTimeout: 300 * time.Millisecond}
+			_, _, err := d.Dial("ws://"+srv.addr+"/?token=2", nil)
+			Convey("Then it should wait for the first to close", func() {
+				So(err, ShouldNotBeNil)
+				st := srv.Stats()
+				So(st.OpenConns, ShouldEqual, 1)
+				So(st.AcceptWaits, ShouldEqual, 1)
+				c.Close()
+				c2, _, err := dialTestServer(srv, "token=3", nil)
+				So(err, ShouldBeNil)
+				c2.Close()
+			})
+		})
+		Reset(func() {
+			c.Close()
+		})
+	})
+}
+
+func TestOfflineBuffer(t *testing.T) {
+	Convey("Given WS server keeping two messages for offline ids", t, func() {
+		srv, err := startTestServer(&Config{
+			Addr:          "localhost:0",
+			Handlers:      tokenHandlers{},
+			OfflineBuffer: 2,
+			OfflineTTL:    300 * time.Millisecond,
+		})
+		So(err, ShouldBeNil)
+		Convey("When three messages are written to an offline id", func() {
+			for _, m := range []string{"a", "b", "c"} {
+				So(srv.WriteMessage(1, []byte(m)), ShouldBeNil)
+			}
+			Convey("Then the last two should be delivered in order on connect", func() {
+				c, _, err := dialTestServer(srv, "token=1", nil)
+				So(err, ShouldBeNil)
+				defer c.Close()
+				for _, m := range []string{"b", "c"} {
+					_, msg, err := c.ReadMessage()
+					So(err, ShouldBeNil)
+					So(string(msg), ShouldEqual, m)
+				}
+			})
+			Convey("Then they should be dropped after OfflineTTL", func() {
+				time.Sleep(400 * time.Millisecond)
+				c, _, err := dialTestServer(srv, "token=1", nil)
+				So(err, ShouldBeNil)
+				defer c.Close()
+				time.Sleep(100 * time.Millisecond)
+				So(srv.WriteMessage(1, []byte("d")), ShouldBeNil)
+				_, msg, err := c.ReadMessage()
+				So(err, ShouldBeNil)
+				So(string(msg), ShouldEqual, "d")
+			})
+		})
+	})
+}
+
+func TestAllowUnauthenticated(t *testing.T) {
+	Convey("Given WS server allowing unauthenticated connections", t, func() {
+		srv, err := startTestServer(&Config{
+			Addr:                 "localhost:0",
+			AllowUnauthenticated: true,
+		})
+		So(err, ShouldBeNil)
+		Convey("When two clients connect without a token", func() {
+			c1, _, err := dialTestServer(srv, "", nil)
+			So(err, ShouldBeNil)
+			c2, _, err := dialTestServer(srv, "", nil)
+			So(err, ShouldBeNil)
+			time.Sleep(time.Millisecond * 100)
+			Convey("Then they should get consecutive ids", func() {
+				So(srv.WriteMessage(1, []byte("one")), ShouldBeNil)
+				So(srv.WriteMessage(2, []byte("two")), ShouldBeNil)
+				_, msg, err := c2.ReadMessage()
+				So(err, ShouldBeNil)
+				So(string(msg), ShouldEqual, "two")
+			})
+			Reset(func() {
+				c1.Close()
+				c2.Close()
+			})
+		})
+	})
+}
+
+func TestHandshakeStats(t *testing.T) {
+	Convey("Given WS server with a slow auth backend", t, func() {
+		srv, err := startTestServer(&Config{
+			Addr: "localhost:0",
+			AuthFunc: func(token string) (uint, bool) {
+				time.Sleep(60 * time.Millisecond)
+				return 1, true
+			},
+		})
+		So(err, ShouldBeNil)
+		Convey("When a client connects", func() {
+			c, _, err := dialTestServer(srv, "token=1", nil)
+			So(err, ShouldBeNil)
+			time.Sleep(time.Millisecond * 100)
+			Convey("Then its handshake should be counted in the 100ms bucket", func() {
+				st := srv.Stats().Handshakes
+				So(st.Count, ShouldEqual, 1)
+				So(st.Total, ShouldBeGreaterThanOrEqualTo, 60*time.Millisecond)
+				So(st.Buckets[2], ShouldEqual, 1)
+				So(HandshakeBuckets()[2], ShouldEqual, 100*time.Millisecond)
+			})
+			Reset(func() {
+				c.Close()
+			})
+		})
+		Convey("Changing the returned bucket bounds should not change them", func() {
+			HandshakeBuckets()[0] = time.Hour
+			So(HandshakeBuckets()[0], ShouldEqual, 10*time.Millisecond)
+		})
+	})
+}
+
+func TestDrain(t *testing.T) {
+	Convey("Given WS server with a connected client", t, func() {
+		h := orderHandlers{texts: make(chan string, 10)}
+		srv, err := startTestServer(&Config{
+			Addr:            "localhost:0",
+			Handlers:        h,
+			OrderedDelivery: true,
+		})
+		So(err, ShouldBeNil)
+		c, _, err := dialTestServer(srv, "token=123456", nil)
+		So(err, ShouldBeNil)
+		time.Sleep(time.Millisecond * 100)
+		Convey("When the server drains", func() {
+			srv.Drain()
+			c.WriteMessage(websocket.TextMessage, []byte("late"))
+			Convey("Then inbound messages should be discarded", func() {
+				So(receivedEvents(h.texts, time.Millisecond*200), ShouldBeEmpty)
+			})
+			Convey("Then the connection should still be written to", func() {
+				sent, failed := srv.Broadcast([]byte("reply"))
+				So(sent, ShouldEqual, 1)
+				So(failed, ShouldEqual, 0)
+				_, msg, err := c.ReadMessage()
+				So(err, ShouldBeNil)
+				So(string(msg), ShouldEqual, "reply")
+			})
+			Convey("Then new connections should be rejected with 503", func() {
+				_, resp, err := dialTestServer(srv, "token=123456", nil)
+				So(err, ShouldEqual, websocket.ErrBadHandshake)
+				So(resp.StatusCode, ShouldEqual, http.StatusServiceUnavailable)
+			})
+		})
+		Reset(func() {
+			c.Close()
+		})
+	})
+}
+
+func TestShutdown(t *testing.T) {
+	Convey("Given WS server with two connected clients", t, func() {
+		h := tokenLifecycleHandlers{lifecycleHandlers{events: make(chan string, 10)}}
+		srv, err := startTestServer(&Config{
+			Addr:     "localhost:0",
+			Handlers: h,
+		})
+		So(err, ShouldBeNil)
+		closeErrs := make(chan error, 2)
+		for _, token := range []string{"1", "2"} {
+			c, _, err := dialTestServer(srv, "token="+token, nil)
+			So(err, ShouldBeNil)
+			So(<-h.events, ShouldEqual, onOnline)
+			go func() {
+				_, _, err := c.ReadMessage()
+				closeErrs <- err
+				c.Close()
+			}()
+		}
+		Convey("When the server shuts down", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			So(srv.Shutdown(ctx), ShouldBeNil)
+			Convey("Then every client should be closed with 1001", func() {
+				for i := 0; i < 2; i++ {
+					So(websocket.IsCloseError(<-closeErrs, websocket.CloseGoingAway), ShouldBeTrue)
+				}
+			})
+			Convey("Then 'OnOffline' should have run for every client", func() {
+				So(receivedEvents(h.events, time.Millisecond*100), ShouldResemble, []string{onOffline, onOffline})
+			})
+			Convey("Then new clients should not connect", func() {
+				_, _, err := dialTestServer(srv, "token=3", nil)
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
+
+func TestShutdownStalledClient(t *testing.T) {
+	Convey("Given WS server with a client that stopped reading", t, func() {
+		h := tokenLifecycleHandlers{lifecycleHandlers{events: make(chan string, 10)}}
+		srv, err := startTestServer(&Config{
+			Addr:     "localhost:0",
+			Handlers: h,
+		})
+		So(err, ShouldBeNil)
+		// net.Pipe is unbuffered, so writes to stalled block until they
+		// are read.
+		stalled, err := pipeDial(srv, func(conn net.Conn) net.Conn { return conn }, "token=1")
+		So(err, ShouldBeNil)
+		So(<-h.events, ShouldEqual, onOnline)
+		c, _, err := dialTestServer(srv, "token=2", nil)
+		So(err, ShouldBeNil)
+		So(<-h.events, ShouldEqual, onOnline)
+		closeErr := make(chan error, 1)
+		go func() {
+			_, _, err := c.ReadMessage()
+			closeErr <- err
+		}()
+		Convey("When the server shuts down", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+			defer cancel()
+			start := time.Now()
+			err := srv.Shutdown(ctx)
+			Convey("Then it should return once ctx ends", func() {
+				So(err == context.DeadlineExceeded, ShouldBeTrue)
+				So(time.Since(start), ShouldBeLessThan, time.Second)
+			})
+			Convey("Then the other client should be closed with 1001", func() {
+				So(websocket.IsCloseError(<-closeErr, websocket.CloseGoingAway), ShouldBeTrue)
+			})
+			Convey("Then 'OnOffline' should have run for both clients", func() {
+				So(receivedEvents(h.events, time.Millisecond*100), ShouldResemble, []string{onOffline, onOffline})
+			})
+		})
+		Reset(func() {
+			stalled.Close()
+			c.Close()
+		})
+	})
+}
+
+func TestCloseConn(t *testing.T) {
+	Convey("Given a connection", t, func() {
+		server, client := net.Pipe()
+		Convey("When it is closed by reference", func() {
+			errs := make(chan error, 1)
+			go func() {
+				errs <- CloseConn(server, ws.StatusPolicyViolation, "Bye")
+			}()
+			Convey("Then the client should get the close frame", func() {
+				f, err := ws.ReadFrame(client)
+				So(err, ShouldBeNil)
+				So(f.Header.OpCode, ShouldEqual, ws.OpClose)
+				code, reason := ws.ParseCloseFrameData(f.Payload)
+				So(code, ShouldEqual, ws.StatusPolicyViolation)
+				So(reason, ShouldEqual, "Bye")
+				So(<-errs, ShouldBeNil)
+				Convey("And the connection should be closed", func() {
+					_, err := client.Read(make([]byte, 1))
+					So(err, ShouldEqual, io.EOF)
+				})
+			})
+		})
+		Convey("When the close frame can't be written", func() {
+			client.Close()
+			Convey("Then the connection should still be closed", func() {
+				So(CloseConn(server, ws.StatusGoingAway, ""), ShouldBeNil)
+				_, err := server.Write([]byte{0})
+				So(err, ShouldEqual, io.ErrClosedPipe)
+			})
+		})
+		Reset(func() {
+			server.Close()
+			client.Close()
+		})
+	})
+}
+
+func TestDiagnostics(t *testing.T) {
+	Convey("Given WS server with a connected client", t, func() {
+		srv, err := startTestServer(&Config{
+			Addr:     "localhost:0",
+			Handlers: THandlers{},
+		})
+		So(err, ShouldBeNil)
+		c, _, err := dialTestServer(srv, "token=123456", nil)
+		So(err, ShouldBeNil)
+		time.Sleep(time.Millisecond * 300)
+		Convey("Then diagnostics should report one conn with one reader", func() {
+			d := srv.Diagnostics()
+			So(d.Conns, ShouldEqual, 1)
+			So(d.Readers, ShouldEqual, 1)
+			So(d.Handlers, ShouldEqual, 0)
+		})
+		Convey("When client disconnects", func() {
+			c.Close()
+			time.Sleep(time.Millisecond * 300)
+			Convey("Then no conns or readers should be left", func() {
+				d := srv.Diagnostics()
+				So(d.Conns, ShouldEqual, 0)
+				So(d.Readers, ShouldEqual, 0)
+			})
+		})
+		Reset(func() {
+			c.Close()
+		})
+	})
+}
+
+type tokenHandlers struct {
+	THandlers
+}
+
+func (h tokenHandlers) OnAuth(token string) (id uint, ok bool) {
+	n, err := strconv.ParseUint(token, 10, 32)
+	return uint(n), err == nil
+}
+
+func TestBroadcast(t *testing.T) {
+	Convey("Given WS server with several clients", t, func() {
+		srv, err := startTestServer(&Config{
+			Addr:             "localhost:0",
+			Handlers:         tokenHandlers{},
+			BroadcastWorkers: 2,
+		})
+		So(err, ShouldBeNil)
+		clients := make([]*websocket.Conn, 0)
+		for i := 1; i <= 3; i++ {
+			c, _, err := dialTestServer(srv, "token="+strconv.Itoa(i), nil)
+			So(err, ShouldBeNil)
+			clients = append(clients, c)
+		}
+		time.Sleep(time.Millisecond * 300)
+		Convey("When server broadcasts a message", func() {
+			sent, failed := srv.Broadcast([]byte("hello all"))
+			Convey("Then every client should receive it", func() {
+				So(sent, ShouldEqual, 3)
+				So(failed, ShouldEqual, 0)
+				for _, c := range clients {
+					_, msg, err := c.ReadMessage()
+					So(err, ShouldBeNil)
+					So(string(msg), ShouldEqual, "hello all")
+				}
+			})
+		})
+		Reset(func() {
+			for _, c := range clients {
+				c.Close()
+			}
+		})
+	})
+}
+
+func TestBroadcastWhereProtocol(t *testing.T) {
+	Convey("Given WS server with v1 and v2 clients", t, func() {
+		srv, err := startTestServer(&Config{
+			Addr:     "localhost:0",
+			Handlers: tokenHandlers{},
+			Upgrader: func(u *ws.Upgrader) {
+				u.Protocol = func(p []byte) bool {
+					return string(p) == "json.v1" || string(p) == "json.v2"
+				}
+			},
+		})
+		So(err, ShouldBeNil)
+		v1, _, err := dialTestServer(srv, "token=1", http.Header{"Sec-WebSocket-Protocol": {"json.v1"}})
+		So(err, ShouldBeNil)
+		v2, _, err := dialTestServer(srv, "token=2", http.Header{"Sec-WebSocket-Protocol": {"json.v2"}})
+		So(err, ShouldBeNil)
+		Convey("When server broadcasts to json.v2", func() {
+			sent, failed := srv.BroadcastWhereProtocol("json.v2", []byte("v2 frame"))
+			Convey("Then only the v2 client should receive it", func() {
+				So(sent, ShouldEqual, 1)
+				So(failed, ShouldEqual, 0)
+				_, msg, err := v2.ReadMessage()
+				So(err, ShouldBeNil)
+				So(string(msg), ShouldEqual, "v2 frame")
+				v1.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+				_, _, err = v1.ReadMessage()
+				So(err, ShouldNotBeNil)
+			})
+		})
+		Reset(func() {
+			v1.Close()
+			v2.Close()
+		})
+	})
+}
+
+type panicSendHandlers struct {
+	THandlers
+}
+
+func (h panicSendHandlers) OnSend(id uint, msg []byte) (ok bool) {
+	panic("OnSend")
+}
+
+func TestPanicPolicy(t *testing.T) {
+	Convey("Given WS server whose 'OnSend' panics", t, func() {
+		Convey("When the panic policy is fail open", func() {
+			srv, err := startTestServer(&Config{
+				Addr:        "localhost:0",
+				Handlers:    panicSendHandlers{},
+				PanicPolicy: PanicFailOpen,
+			})
+			So(err, ShouldBeNil)
+			c, _, err := dialTestServer(srv, "token=123456", nil)
+			So(err, ShouldBeNil)
+			time.Sleep(time.Millisecond * 300)
+			Convey("Then the message should still be sent", func() {
+				So(srv.WriteMessage(1, []byte("hello")), ShouldBeNil)
+				_, msg, err := c.ReadMessage()
+				So(err, ShouldBeNil)
+				So(string(msg), ShouldEqual, "hello")
+			})
+			Reset(func() {
+				c.Close()
+			})
+		})
+		Convey("When the panic policy is to close the connection", func() {
+			srv, err := startTestServer(&Config{
+				Addr:        "localhost:0",
+				Handlers:    panicSendHandlers{},
+				PanicPolicy: PanicCloseConn,
+			})
+			So(err, ShouldBeNil)
+			c, _, err := dialTestServer(srv, "token=123456", nil)
+			So(err, ShouldBeNil)
+			time.Sleep(time.Millisecond * 300)
+			Convey("Then the connection should be closed", func() {
+				So(srv.WriteMessage(1, []byte("hello")), ShouldBeNil)
+				_, _, err := c.ReadMessage()
+				So(err, ShouldNotBeNil)
+			})
+			Reset(func() {
+				c.Close()
+			})
+		})
+	})
+}
+
+// gatedPanicHandlers panic in 'OnText' once gate is closed, closing
+// entered and panicked on the way.
+type gatedPanicHandlers struct {
+	THandlers
+	entered  chan struct{}
+	gate     chan struct{}
+	panicked chan struct{}
+}
+
+func (h gatedPanicHandlers) OnText(id uint, msg []byte) {
+	close(h.entered)
+	<-h.gate
+	defer close(h.panicked)
+	panic("OnText")
+}
+
+func TestPanicCloseConnReconnected(t *testing.T) {
+	Convey("Given WS server closing connections whose 'OnText' panics", t, func() {
+		h := gatedPanicHandlers{
+			entered:  make(chan struct{}),
+			gate:     make(chan struct{}),
+			panicked: make(chan struct{}),
+		}
+		srv, err := startTestServer(&Config{
+			Addr:        "localhost:0",
+			Handlers:    h,
+			PanicPolicy: PanicCloseConn,
+		})
+		So(err, ShouldBeNil)
+		c1, _, err := dialTestServer(srv, "token=123456", nil)
+		So(err, ShouldBeNil)
+		So(c1.WriteMessage(websocket.TextMessage, []byte("boom")), ShouldBeNil)
+		<-h.entered
+		Convey("When the client reconnects before 'OnText' panics", func() {
+			c2, _, err := dialTestServer(srv, "token=123456", nil)
+			So(err, ShouldBeNil)
+			time.Sleep(time.Millisecond * 100)
+			close(h.gate)
+			<-h.panicked
+			time.Sleep(time.Millisecond * 100)
+			Convey("Then the new connection should stay open", func() {
+				So(srv.WriteMessage(1, []byte("hello")), ShouldBeNil)
+				c2.SetReadDeadline(time.Now().Add(time.Second))
+				_, msg, err := c2.ReadMessage()
+				So(err, ShouldBeNil)
+				So(string(msg), ShouldEqual, "hello")
+			})
+			Reset(func() {
+				c2.Close()
+			})
+		})
+		Reset(func() {
+			c1.Close()
+		})
+	})
+}
+
+func TestSendAndClose(t *testing.T) {
+	Convey("Given WS server with a connected client", t, func() {
+		srv, err := startTestServer(&Config{
+			Addr:     "localhost:0",
+			Handlers: THandlers{},
+		})
+		So(err, ShouldBeNil)
+		c, _, err := dialTestServer(srv, "token=123456", nil)
+		So(err, ShouldBeNil)
+		time.Sleep(time.Millisecond * 300)
+		Convey("When server sends a final message and closes", func() {
+			So(srv.SendAndClose(1, []byte("session expired"), ws.StatusPolicyViolation, "expired"), ShouldBeNil)
+			Convey("Then client should receive the message before the close", func() {
+				_, msg, err := c.ReadMessage()
+				So(err, ShouldBeNil)
+				So(string(msg), ShouldEqual, "session expired")
+				_, _, err = c.ReadMessage()
+				So(websocket.IsCloseError(err, websocket.ClosePolicyViolation), ShouldBeTrue)
+			})
+		})
+		Reset(func() {
+			c.Close()
+		})
+	})
+}
+
+func TestHandleConn(t *testing.T) {
+	Convey("Given WS server without a listener", t, func() {
+		h := orderHandlers{texts: make(chan string, 1)}
+		srv, err := New(&Config{Handlers: h})
+		So(err, ShouldBeNil)
+		Convey("When client connects over an in-memory pipe", func() {
+			server, client := net.Pipe()
+			go srv.HandleConn(server)
+			d := websocket.Dialer{
+				NetDial: func(network, addr string) (net.Conn, error) {
+					return client, nil
+				},
+			}
+			c, _, err := d.Dial("ws://pipe/?token=123456", nil)
+			So(err, ShouldBeNil)
+			c.WriteMessage(websocket.TextMessage, []byte("hello"))
+			Convey("Then 'OnText' should receive the message", func() {
+				So(<-h.texts, ShouldEqual, "hello")
+			})
+			Reset(func() {
+				c.Close()
+			})
+		})
+	})
+}
+
+// failingConn fails every write once fail is set.
+type failingConn struct {
+	net.Conn
+	fail int32
+}
+
+var errWriteFailed = errors.New("write failed")
+
+func (c *failingConn) Write(p []byte) (int, error) {
+	if atomic.LoadInt32(&c.fail) == 1 {
+		return 0, errWriteFailed
+	}
+	return c.Conn.Write(p)
+}
+
+// tempErr is a temporary net.Error, like EAGAIN.
+type tempErr struct{}
+
+func (tempErr) Error() string   { return "resource temporarily unavailable" }
+func (tempErr) Timeout() bool   { return false }
+func (tempErr) Temporary() bool { return true }
+
+// flakyConn fails the next fails writes with err, counting attempts.
+type flakyConn struct {
+	net.Conn
+	err      error
+	fails    int32
+	attempts int32
+}
+
+func (c *flakyConn) Write(p []byte) (int, error) {
+	atomic.AddInt32(&c.attempts, 1)
+	if atomic.AddInt32(&c.fails, -1) >= 0 {
+		return 0, c.err
+	}
+	return c.Conn.Write(p)
+}
+
+func TestWriteRetries(t *testing.T) {
+	Convey("Given WS server retrying writes twice", t, func() {
+		srv, err := New(&Config{
+			Handlers:     tokenHandlers{},
+			WriteRetries: 2,
+		})
+		So(err, ShouldBeNil)
+		fc := &flakyConn{}
+		c, err := pipeDial(srv, func(conn net.Conn) net.Conn {
+			fc.Conn = conn
+			return fc
+		}, "token=1")
+		So(err, ShouldBeNil)
+		time.Sleep(time.Millisecond * 100)
+		Convey("When writes fail twice with a temporary error", func() {
+			fc.err = tempErr{}
+			atomic.StoreInt32(&fc.fails, 2)
+			go srv.WriteMessage(1, []byte("hello"))
+			Convey("Then the message should be delivered by the last retry", func() {
+				_, msg, err := c.ReadMessage()
+				So(err, ShouldBeNil)
+				So(string(msg), ShouldEqual, "hello")
+			})
+		})
+		Convey("When writes keep failing with a temporary error", func() {
+			fc.err = tempErr{}
+			atomic.StoreInt32(&fc.attempts, 0)
+			atomic.StoreInt32(&fc.fails, 3)
+			Convey("Then the write should fail after the retries", func() {
+				So(srv.WriteMessage(1, []byte("hello")), ShouldResemble, tempErr{})
+				So(atomic.LoadInt32(&fc.attempts), ShouldEqual, 3)
+			})
+		})
+		Convey("When a write fails with another error", func() {
+			fc.err = errWriteFailed
+			atomic.StoreInt32(&fc.attempts, 0)
+			atomic.StoreInt32(&fc.fails, 1)
+			Convey("Then it should not be retried", func() {
+				So(srv.WriteMessage(1, []byte("hello")), ShouldEqual, errWriteFailed)
+				So(atomic.LoadInt32(&fc.attempts), ShouldEqual, 1)
+			})
+		})
+		Reset(func() {
+			c.Close()
+		})
+	})
+}
+
+func TestOnWriteError(t *testing.T) {
+	Convey("Given WS server evicting after two failed writes", t, func() {
+		writeErrs := make(chan error, 2)
+		h := reasonHandlers{reasons: make(chan OfflineReason, 1)}
+		srv, err := New(&Config{
+			Handlers: h,
+			OnWriteError: func(id uint, err error) {
+				writeErrs <- err
+			},
+			MaxWriteErrors: 2,
+		})
+		So(err, ShouldBeNil)
+		server, client := net.Pipe()
+		fc := &failingConn{Conn: server}
+		go srv.HandleConn(fc)
+		d := websocket.Dialer{
+			NetDial: func(network, addr string) (net.Conn, error) {
+				return client, nil
+			},
+		}
+		c, _, err := d.Dial("ws://pipe/?token=1", nil)
+		So(err, ShouldBeNil)
+		time.Sleep(time.Millisecond * 100)
+		Convey("When writes to the connection fail", func() {
+			atomic.StoreInt32(&fc.fail, 1)
+			So(srv.WriteMessage(1, []byte("a")), ShouldEqual, errWriteFailed)
+			Convey("Then 'OnWriteError' should be called", func() {
+				So(<-writeErrs, ShouldEqual, errWriteFailed)
+			})
+			Convey("Then the second failure should close the connection", func() {
+				srv.WriteMessage(1, []byte("b"))
+				_, _, err := c.ReadMessage()
+				So(err, ShouldNotBeNil)
+			})
+			Convey("Then the evicted connection should go offline with ErrWriteErrors", func() {
+				srv.WriteMessage(1, []byte("b"))
+				So((<-h.reasons).Err, ShouldEqual, ErrWriteErrors)
+				So(srv.WriteMessage(1, []byte("c")), ShouldEqual, ErrConnNotFound)
+			})
+		})
+		Reset(func() {
+			c.Close()
+		})
+	})
+}
+
+func TestEchoHandlers(t *testing.T) {
+	Convey("Given WS server with echo handlers", t, func() {
+		srv, err := startTestServer(&Config{
+			Addr:     "localhost:0",
+			Handlers: &EchoHandlers{},
+		})
+		So(err, ShouldBeNil)
+		Convey("When two clients send messages", func() {
+			c1, _, err := dialTestServer(srv, "token=any", nil)
+			So(err, ShouldBeNil)
+			c2, _, err := dialTestServer(srv, "token=any", nil)
+			So(err, ShouldBeNil)
+			So(c1.WriteMessage(websocket.TextMessage, []byte("one")), ShouldBeNil)
+			So(c2.WriteMessage(websocket.TextMessage, []byte("two")), ShouldBeNil)
+			Convey("Then each should receive its own message back", func() {
+				_, msg, err := c1.ReadMessage()
+				So(err, ShouldBeNil)
+				So(string(msg), ShouldEqual, "one")
+				_, msg, err = c2.ReadMessage()
+				So(err, ShouldBeNil)
+				So(string(msg), ShouldEqual, "two")
+			})
+			Reset(func() {
+				c1.Close()
+				c2.Close()
+			})
+		})
+	})
+}
+
+type onlyAuthHandlers struct {
+	NoopHandlers
+	texts chan string
+}
+
+func (h onlyAuthHandlers) OnAuth(token string) (id uint, ok bool) {
+	return 1, token == "123456"
+}
+
+func (h onlyAuthHandlers) OnText(id uint, msg []byte) {
+	h.texts <- string(msg)
+}
+
+func TestNoopHandlers(t *testing.T) {
+	Convey("Given WS server with handlers overriding only some NoopHandlers methods", t, func() {
+		h := onlyAuthHandlers{texts: make(chan string, 1)}
+		srv, err := startTestServer(&Config{
+			Addr:     "localhost:0",
+			Handlers: h,
+		})
+		So(err, ShouldBeNil)
+		Convey("When client sends a message", func() {
+			c, _, err := dialTestServer(srv, "token=123456", nil)
+			So(err, ShouldBeNil)
+			So(c.WriteMessage(websocket.TextMessage, []byte("hello")), ShouldBeNil)
+			Convey("Then the overridden method should receive it", func() {
+				So(<-h.texts, ShouldEqual, "hello")
+			})
+			Convey("Then writes should pass the default OnSend", func() {
+				So(srv.WriteMessage(1, []byte("hi")), ShouldBeNil)
+				_, msg, err := c.ReadMessage()
+				So(err, ShouldBeNil)
+				So(string(msg), ShouldEqual, "hi")
+			})
+			Reset(func() {
+				c.Close()
+			})
+		})
+	})
+	Convey("Given WS server with bare NoopHandlers", t, func() {
+		srv, err := startTestServer(&Config{
+			Addr:     "localhost:0",
+			Handlers: NoopHandlers{},
+		})
+		So(err, ShouldBeNil)
+		Convey("Then every token should be rejected", func() {
+			_, _, err := dialTestServer(srv, "token=123456", nil)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestRecordingConnController(t *testing.T) {
+	Convey("Given echo handlers with a recording controller", t, func() {
+		rec := &RecordingConnController{}
+		h := &EchoHandlers{}
+		h.SetConnCtrlr(rec)
+		Convey("When handlers receive messages", func() {
+			h.OnText(1, []byte("one"))
+			h.OnText(2, []byte("two"))
+			rec.CloseConnection(2)
+			Convey("Then the controller should record the calls in order", func() {
+				So(rec.Messages(), ShouldResemble, []RecordedMessage{
+					{ID: 1, Msg: []byte("one")},
+					{ID: 2, Msg: []byte("two")},
+				})
+				So(rec.Closed(), ShouldResemble, []uint{2})
+			})
+			Convey("Then Reset should forget them", func() {
+				rec.Reset()
+				So(rec.Messages(), ShouldBeEmpty)
+				So(rec.Closed(), ShouldBeEmpty)
+			})
+		})
+	})
+}
+
+func TestConnInfo(t *testing.T) {
+	Convey("Given WS server accepting a subprotocol and permessage-deflate", t, func() {
+		srv, err := startTestServer(&Config{
+			Addr:     "localhost:0",
+			Handlers: tokenHandlers{},
+			Upgrader: func(u *ws.Upgrader) {
+				u.Protocol = func(p []byte) bool {
+					return string(p) == "chat"
+				}
+				u.Extension = func(opt httphead.Option) bool {
+					return string(opt.Name) == ExtensionDeflate
+				}
+			},
+		})
+		So(err, ShouldBeNil)
+		Convey("When a client offering both connects", func() {
+			d := websocket.Dialer{Subprotocols: []string{"chat"}, EnableCompression: true}
+			c, _, err := d.Dial("ws://"+srv.addr+"/?token=1", nil)
+			So(err, ShouldBeNil)
+			time.Sleep(time.Millisecond * 100)
+			Convey("Then 'ConnInfo' should report what was negotiated", func() {
+				info, err := srv.ConnInfo(1)
+				So(err, ShouldBeNil)
+				So(info.Protocol, ShouldEqual, "chat")
+				So(info.Extensions, ShouldResemble, []string{ExtensionDeflate})
+				So(srv.CompressionEnabled(1), ShouldBeTrue)
+			})
+			Reset(func() {
+				c.Close()
+			})
+		})
+		Convey("When a client without compression connects", func() {
+			c, _, err := dialTestServer(srv, "token=2", nil)
+			So(err, ShouldBeNil)
+			time.Sleep(time.Millisecond * 100)
+			Convey("Then compression should not be enabled", func() {
+				So(srv.CompressionEnabled(2), ShouldBeFalse)
+			})
+			Reset(func() {
+				c.Close()
+			})
+		})
+	})
+}
+
+func TestCompressedMessages(t *testing.T) {
+	Convey("Given WS server accepting permessage-deflate", t, func() {
+		h := orderHandlers{texts: make(chan string, 1)}
+		srv, err := startTestServer(&Config{
+			Addr:            "localhost:0",
+			Handlers:        h,
+			OrderedDelivery: true,
+			Upgrader: func(u *ws.Upgrader) {
+				u.Extension = func(opt httphead.Option) bool {
+					return string(opt.Name) == ExtensionDeflate
+				}
+			},
+		})
+		So(err, ShouldBeNil)
+		Convey("When a client sends a compressed message", func() {
+			d := websocket.Dialer{EnableCompression: true}
+			c, _, err := d.Dial("ws://"+srv.addr+"/?token=123456", nil)
+			So(err, ShouldBeNil)
+			c.EnableWriteCompression(true)
+			msg := strings.Repeat("hello ", 100)
+			So(c.WriteMessage(websocket.TextMessage, []byte(msg)), ShouldBeNil)
+			Convey("Then 'OnText' should receive it inflated", func() {
+				So(<-h.texts, ShouldEqual, msg)
+			})
+			Reset(func() {
+				c.Close()
+			})
+		})
+		Convey("When a client that didn't negotiate it sets RSV1", func() {
+			conn, _, _, err := ws.Dial(context.Background(), "ws://"+srv.addr+"/?token=123456")
+			So(err, ShouldBeNil)
+			f := ws.NewTextFrame([]byte("hello"))
+			f.Header.Rsv = ws.Rsv(true, false, false)
+			So(ws.WriteFrame(conn, ws.MaskFrameInPlace(f)), ShouldBeNil)
+			Convey("Then it should be closed with 1002 and a reason", func() {
+				f, err := ws.ReadFrame(conn)
+				So(err, ShouldBeNil)
+				code, reason := ws.ParseCloseFrameData(f.Payload)
+				So(code, ShouldEqual, ws.StatusProtocolError)
+				So(reason, ShouldEqual, string(ws.ErrProtocolNonZeroRsv))
+				So(len(h.texts), ShouldEqual, 0)
+			})
+			Reset(func() {
+				conn.Close()
+			})
+		})
+	})
+}
+
+// deflateFrames compresses msgs as permessage-deflate text frames from one
+// compressor, keeping the context between them like browsers do.
+func deflateFrames(msgs ...string) []ws.Frame {
+	var buf bytes.Buffer
+	fw, _ := flate.NewWriter(&buf, flate.BestCompression)
+	frames := make([]ws.Frame, len(msgs))
+	for i, msg := range msgs {
+		buf.Reset()
+		fw.Write([]byte(msg))
+		fw.Flush()
+		p := bytes.TrimSuffix(buf.Bytes(), []byte{0, 0, 0xff, 0xff})
+		f := ws.NewTextFrame(append([]byte(nil), p...))
+		f.Header.Rsv = ws.Rsv(true, false, false)
+		frames[i] = ws.MaskFrameInPlace(f)
+	}
+	return frames
+}
+
+func TestCompressionContextTakeover(t *testing.T) {
+	Convey("Given WS server accepting permessage-deflate with a message size limit", t, func() {
+		h := orderHandlers{texts: make(chan string, 2)}
+		srv, err := startTestServer(&Config{
+			Addr:            "localhost:0",
+			Handlers:        h,
+			OrderedDelivery: true,
+			MaxMessageSize:  1000,
+			Upgrader: func(u *ws.Upgrader) {
+				u.Extension = func(opt httphead.Option) bool {
+					return string(opt.Name) == ExtensionDeflate
+				}
+			},
+		})
+		So(err, ShouldBeNil)
+		d := ws.Dialer{Extensions: []httphead.Option{{Name: []byte(ExtensionDeflate)}}}
+		conn, _, hs, err := d.Dial(context.Background(), "ws://"+srv.addr+"/?token=123456")
+		So(err, ShouldBeNil)
+		So(hs.Extensions, ShouldHaveLength, 1)
+		Convey("When a client keeps its compression context between messages", func() {
+			msg := strings.Repeat("hello ", 100)
+			for _, f := range deflateFrames(msg, msg) {
+				So(ws.WriteFrame(conn, f), ShouldBeNil)
+			}
+			Convey("Then 'OnText' should receive both inflated", func() {
+				So(<-h.texts, ShouldEqual, msg)
+				So(<-h.texts, ShouldEqual, msg)
+			})
+		})
+		Convey("When a compressed message inflates over the limit", func() {
+			for _, f := range deflateFrames(strings.Repeat("a", 10000)) {
+				So(ws.WriteFrame(conn, f), ShouldBeNil)
+			}
+			Convey("Then it should be closed with 1009", func() {
+				f, err := ws.ReadFrame(conn)
+				So(err, ShouldBeNil)
+				code, _ := ws.ParseCloseFrameData(f.Payload)
+				So(code, ShouldEqual, ws.StatusMessageTooBig)
+				So(len(h.texts), ShouldEqual, 0)
+			})
+		})
+		Reset(func() {
+			conn.Close()
+		})
+	})
+}
+
+func TestOnConnect(t *testing.T) {
+	Convey("Given WS server with an audit callback", t, func() {
+		infos := make(chan ConnInfo, 1)
+		srv, err := startTestServer(&Config{
+			Addr:     "localhost:0",
+			Handlers: tokenHandlers{},
+			OnConnect: func(info ConnInfo) {
+				infos <- info
+			},
+		})
+		So(err, ShouldBeNil)
+		Convey("When a client connects", func() {
+			c, _, err := dialTestServer(srv, "token=3", nil)
+			So(err, ShouldBeNil)
+			Convey("Then 'OnConnect' should receive who, from where and when", func() {
+				info := <-infos
+				So(info.ID, ShouldEqual, 3)
+				So(info.RemoteAddr, ShouldEqual, c.LocalAddr().String())
+				So(time.Since(info.Connected), ShouldBeLessThan, time.Second)
+			})
+			Reset(func() {
+				c.Close()
+			})
+		})
+		Convey("A rejected client should not be reported", func() {
+			_, _, err := dialTestServer(srv, "token=x", nil)
+			So(err, ShouldNotBeNil)
+			So(len(infos), ShouldEqual, 0)
+		})
+	})
+}
+
+type connIDHandlers struct {
+	THandlers
+}
+
+func (h connIDHandlers) OnTextContext(ctx context.Context, id uint, msg []byte) {
+	Reply(ctx, []byte(ConnID(ctx)))
+}
+
+func TestConnID(t *testing.T) {
+	Convey("Given WS server passing the ConnID to its handler", t, func() {
+		infos := make(chan ConnInfo, 2)
+		srv, err := startTestServer(&Config{
+			Addr:     "localhost:0",
+			Handlers: connIDHandlers{},
+			OnConnect: func(info ConnInfo) {
+				infos <- info
+			},
+		})
+		So(err, ShouldBeNil)
+		Convey("When the same id connects twice", func() {
+			c1, _, err := dialTestServer(srv, "token=1", nil)
+			So(err, ShouldBeNil)
+			first := <-infos
+			c2, _, err := dialTestServer(srv, "token=1", nil)
+			So(err, ShouldBeNil)
+			second := <-infos
+			Convey("Then each connection should get its own UUID", func() {
+				So(first.ConnID, ShouldHaveLength, 36)
+				So(second.ConnID, ShouldHaveLength, 36)
+				So(first.ConnID, ShouldNotEqual, second.ConnID)
+			})
+			Convey("Then handlers should see the ConnID of the current connection", func() {
+				info, err := srv.ConnInfo(1)
+				So(err, ShouldBeNil)
+				So(info.ConnID, ShouldEqual, second.ConnID)
+				So(c2.WriteMessage(websocket.TextMessage, []byte("who")), ShouldBeNil)
+				_, msg, err := c2.ReadMessage()
+				So(err, ShouldBeNil)
+				So(string(msg), ShouldEqual, second.ConnID)
+			})
+			Reset(func() {
+				c1.Close()
+				c2.Close()
+			})
+		})
+		Convey("ConnID outside OnTextContext should be empty", func() {
+			So(ConnID(context.Background()), ShouldEqual, "")
+		})
+	})
+}
+
+func TestUpgradeHandler(t *testing.T) {
+	Convey("Given WS server mounted on an HTTP server next to REST routes", t, func() {
+		srv, err := New(&Config{Handlers: &EchoHandlers{}})
+		So(err, ShouldBeNil)
+		mux := http.NewServeMux()
+		mux.HandleFunc("/api", func(rw http.ResponseWriter, r *http.Request) {
+			rw.Write([]byte("rest"))
+		})
+		mux.Handle("/ws", srv.UpgradeHandler())
+		hs := httptest.NewServer(mux)
+		Convey("When a client connects to the WebSocket path", func() {
+			c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(hs.URL, "http")+"/ws?token=1", nil)
+			So(err, ShouldBeNil)
+			So(c.WriteMessage(websocket.TextMessage, []byte("hello")), ShouldBeNil)
+			Convey("Then messages should round-trip", func() {
+				_, msg, err := c.ReadMessage()
+				So(err, ShouldBeNil)
+				So(string(msg), ShouldEqual, "hello")
+			})
+			Reset(func() {
+				c.Close()
+			})
+		})
+		Convey("Then REST routes should still be served", func() {
+			resp, err := http.Get(hs.URL + "/api")
+			So(err, ShouldBeNil)
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			So(string(body), ShouldEqual, "rest")
+		})
+		Reset(func() {
+			hs.Close()
+		})
+	})
+}
+
+type ctxHandlers struct {
+	THandlers
+	errs chan error
+}
+
+func (h ctxHandlers) OnTextContext(ctx context.Context, id uint, msg []byte) {
+	<-ctx.Done()
+	h.errs <- ctx.Err()
+}
+
+type replyHandlers struct {
+	THandlers
+}
+
+func (h replyHandlers) OnTextContext(ctx context.Context, id uint, msg []byte) {
+	Reply(ctx, append([]byte("re: "), msg...))
+}
+
+func TestReply(t *testing.T) {
+	Convey("Given WS server replying to every message", t, func() {
+		srv, err := startTestServer(&Config{
+			Addr:     "localhost:0",
+			Handlers: replyHandlers{},
+		})
+		So(err, ShouldBeNil)
+		c, _, err := dialTestServer(srv, "token=123456", nil)
+		So(err, ShouldBeNil)
+		Convey("When client sends a message", func() {
+			c.WriteMessage(websocket.TextMessage, []byte("hello"))
+			Convey("Then it should receive the reply", func() {
+				_, msg, err := c.ReadMessage()
+				So(err, ShouldBeNil)
+				So(string(msg), ShouldEqual, "re: hello")
+			})
+		})
+		Convey("Replying outside OnTextContext should fail", func() {
+			So(Reply(context.Background(), []byte("x")), ShouldEqual, ErrNoReply)
+		})
+		Reset(func() {
+			c.Close()
+		})
+	})
+}
+
+// lateReplyHandlers reply to a message once gate is closed and pass on
+// the error of Reply.
+type lateReplyHandlers struct {
+	THandlers
+	entered chan struct{}
+	gate    chan struct{}
+	errs    chan error
+}
+
+func (h lateReplyHandlers) OnTextContext(ctx context.Context, id uint, msg []byte) {
+	close(h.entered)
+	<-h.gate
+	h.errs <- Reply(ctx, []byte("late"))
+}
+
+func TestReplyAfterReconnect(t *testing.T) {
+	Convey("Given WS server replying late to a message", t, func() {
+		h := lateReplyHandlers{
+			entered: make(chan struct{}),
+			gate:    make(chan struct{}),
+			errs:    make(chan error, 1),
+		}
+		srv, err := startTestServer(&Config{
+			Addr:     "localhost:0",
+			Handlers: h,
+		})
+		So(err, ShouldBeNil)
+		c1, _, err := dialTestServer(srv, "token=123456", nil)
+		So(err, ShouldBeNil)
+		So(c1.WriteMessage(websocket.TextMessage, []byte("hello")), ShouldBeNil)
+		<-h.entered
+		Convey("When the client reconnects before the reply", func() {
+			c2, _, err := dialTestServer(srv, "token=123456", nil)
+			So(err, ShouldBeNil)
+			time.Sleep(time.Millisecond * 100)
+			close(h.gate)
+			Convey("Then Reply should fail with ErrConnClosed", func() {
+				So(<-h.errs, ShouldEqual, ErrConnClosed)
+			})
+			Convey("Then the new connection should not get the reply", func() {
+				c2.SetReadDeadline(time.Now().Add(time.Millisecond * 200))
+				_, _, err := c2.ReadMessage()
+				So(err, ShouldNotBeNil)
+			})
+			Reset(func() {
+				c2.Close()
+			})
+		})
+		Reset(func() {
+			c1.Close()
+		})
+	})
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	Convey("Given WS server with a handler timeout", t, func() {
+		h := ctxHandlers{errs: make(chan error, 1)}
+		lines := make(logLines, 10)
+		srv, err := startTestServer(&Config{
+			Addr:           "localhost:0",
+			Handlers:       h,
+			Logger:         log.New(lines, "", 0),
+			HandlerTimeout: 100 * time.Millisecond,
+		})
+		So(err, ShouldBeNil)
+		c, _, err := dialTestServer(srv, "token=123456", nil)
+		So(err, ShouldBeNil)
+		Convey("When a handler outlives the timeout", func() {
+			So(c.WriteMessage(websocket.TextMessage, []byte("slow")), ShouldBeNil)
+			Convey("Then its context should be canceled by the deadline", func() {
+				So(<-h.errs == context.DeadlineExceeded, ShouldBeTrue)
+			})
+			Convey("Then the overrun should be logged with the ConnID", func() {
+				info, err := srv.ConnInfo(1)
+				So(err, ShouldBeNil)
+				<-h.errs
+				var overruns []string
+				for _, l := range receivedEvents(lines, 100*time.Millisecond) {
+					if strings.Contains(l, "exceeded HandlerTimeout") {
+						overruns = append(overruns, l)
+					}
+				}
+				So(overruns, ShouldHaveLength, 1)
+				So(overruns[0], ShouldStartWith, "[1 "+info.ConnID+"]")
+			})
+		})
+		Reset(func() {
+			c.Close()
+		})
+	})
+	Convey("Given WS server without a handler timeout", t, func() {
+		h := ctxHandlers{errs: make(chan error, 1)}
+		srv, err := startTestServer(&Config{
+			Addr:     "localhost:0",
+			Handlers: h,
+		})
+		So(err, ShouldBeNil)
+		c, _, err := dialTestServer(srv, "token=123456", nil)
+		So(err, ShouldBeNil)
+		Convey("When the client disconnects during a handler", func() {
+			So(c.WriteMessage(websocket.TextMessage, []byte("slow")), ShouldBeNil)
+			time.Sleep(time.Millisecond * 100)
+			c.Close()
+			Convey("Then its context should be canceled", func() {
+				So(<-h.errs, ShouldEqual, context.Canceled)
+			})
+		})
+	})
+}
+
+func TestOnDrop(t *testing.T) {
+	Convey("Given WS server batching writes", t, func() {
+		drops := make(chan string, 2)
+		srv, err := New(&Config{
+			Handlers:       tokenHandlers{},
+			CoalesceWindow: 50 * time.Millisecond,
+			OnDrop: func(id uint, msg []byte) {
+				drops <- string(msg)
+			},
+		})
+		So(err, ShouldBeNil)
+		server, client := net.Pipe()
+		fc := &failingConn{Conn: server}
+		go srv.HandleConn(fc)
+		d := websocket.Dialer{
+			NetDial: func(network, addr string) (net.Conn, error) {
+				return client, nil
+			},
+		}
+		c, _, err := d.Dial("ws://pipe/?token=1", nil)
+		So(err, ShouldBeNil)
+		time.Sleep(time.Millisecond * 100)
+		Convey("When the batch write fails", func() {
+			atomic.StoreInt32(&fc.fail, 1)
+			So(srv.WriteMessage(1, []byte("a")), ShouldBeNil)
+			So(srv.WriteMessage(1, []byte("b")), ShouldBeNil)
+			Convey("Then 'OnDrop' should receive every batched message", func() {
+				So(<-drops, ShouldEqual, "a")
+				So(<-drops, ShouldEqual, "b")
+			})
+		})
+		Reset(func() {
+			c.Close()
+		})
+	})
+}
+
+// gateConn holds writes, once armed and skip writes let through, until
+// release is closed.
+type gateConn struct {
+	net.Conn
+	armed   int32
+	skip    int32
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (c *gateConn) Write(p []byte) (int, error) {
+	if atomic.LoadInt32(&c.armed) == 1 && atomic.AddInt32(&c.skip, -1) < 0 &&
+		atomic.CompareAndSwapInt32(&c.armed, 1, 0) {
+		close(c.entered)
+		<-c.release
+	}
+	return c.Conn.Write(p)
+}
+
+func pipeDial(srv *WS, conn func(net.Conn) net.Conn, query string) (*websocket.Conn, error) {
+	server, client := net.Pipe()
+	go srv.HandleConn(conn(server))
+	d := websocket.Dialer{
+		NetDial: func(network, addr string) (net.Conn, error) {
+			return client, nil
+		},
+	}
+	c, _, err := d.Dial("ws://pipe/?"+query, nil)
+	return c, err
+}
+
+func TestWriteDuringReconnect(t *testing.T) {
+	Convey("Given WS server with a connected client", t, func() {
+		srv, err := New(&Config{Handlers: tokenHandlers{}})
+		So(err, ShouldBeNil)
+		g := &gateConn{entered: make(chan struct{}), release: make(chan struct{})}
+		c1, err := pipeDial(srv, func(conn net.Conn) net.Conn {
+			g.Conn = conn
+			return g
+		}, "token=1")
+		So(err, ShouldBeNil)
+		time.Sleep(time.Millisecond * 100)
+		Convey("When the client reconnects during a write to its id", func() {
+			atomic.StoreInt32(&g.armed, 1)
+			written := make(chan error, 1)
+			go func() {
+				written <- srv.WriteMessage(1, []byte("hello"))
+			}()
+			<-g.entered
+			c2, err := pipeDial(srv, func(conn net.Conn) net.Conn { return conn }, "token=1")
+			So(err, ShouldBeNil)
+			received := make(chan string, 1)
+			go func() {
+				// Writes to a pipe block until they are read.
+				_, msg, _ := c2.ReadMessage()
+				received <- string(msg)
+			}()
+			time.Sleep(time.Millisecond * 100)
+			close(g.release)
+			Convey("Then the write should be retried on the new connection", func() {
+				So(<-written, ShouldBeNil)
+				So(<-received, ShouldEqual, "hello")
+			})
+			Reset(func() {
+				c2.Close()
+			})
+		})
+		Reset(func() {
+			c1.Close()
+		})
+	})
+}
+
+func TestCloseDuringWrite(t *testing.T) {
+	Convey("Given WS server with a connected client", t, func() {
+		srv, err := New(&Config{Handlers: tokenHandlers{}})
+		So(err, ShouldBeNil)
+		g := &gateConn{entered: make(chan struct{}), release: make(chan struct{})}
+		c, err := pipeDial(srv, func(conn net.Conn) net.Conn {
+			g.Conn = conn
+			return g
+		}, "token=1")
+		So(err, ShouldBeNil)
+		time.Sleep(time.Millisecond * 100)
+		Convey("When the connection is closed between the header and payload of a write", func() {
+			received := make(chan string, 2)
+			go func() {
+				// Writes to a pipe block until they are read.
+				for {
+					_, msg, err := c.ReadMessage()
+					if err != nil {
+						received <- err.Error()
+						return
+					}
+					received <- string(msg)
+				}
+			}()
+			g.skip = 1
+			atomic.StoreInt32(&g.armed, 1)
+			go srv.WriteMessage(1, []byte("hello"))
+			<-g.entered
+			go srv.CloseConnection(1)
+			time.Sleep(time.Millisecond * 100)
+			close(g.release)
+			Convey("Then the close frame should follow the whole message", func() {
+				So(<-received, ShouldEqual, "hello")
+				So(<-received, ShouldContainSubstring, "1002")
+			})
+		})
+		Reset(func() {
+			c.Close()
+		})
+	})
+}
+
+func TestAuthProtocol(t *testing.T) {
+	Convey("Given WS server authenticating by subprotocol", t, func() {
+		srv, err := startTestServer(&Config{
+			Addr:               "localhost:0",
+			Handlers:           THandlers{},
+			AuthProtocolPrefix: "auth.",
+		})
+		So(err, ShouldBeNil)
+		Convey("When we connect with the token as a subprotocol", func() {
+			runned.reset()
+			d := websocket.Dialer{Subprotocols: []string{"auth.123456"}}
+			c, _, err := d.Dial("ws://"+srv.addr+"/", nil)
+			So(err, ShouldBeNil)
+			Convey("Then 'OnAuth' should be called and the subprotocol echoed", func() {
+				So(runned.list(), ShouldContain, onAuth)
+				So(c.Subprotocol(), ShouldEqual, "auth.123456")
+			})
+			Reset(func() {
+				c.Close()
+			})
+		})
+	})
+}
+
+func TestListenError(t *testing.T) {
+	Convey("Given an address already in use", t, func() {
+		Convey("When we start WS server on it", func() {
+			_, err := Start(&Config{
+				Addr:     wsServer.addr,
+				Handlers: THandlers{},
+			})
+			Convey("Then error should be 'ErrListen' wrapping the '*net.OpError'", func() {
+				So(errors.Is(err, ErrListen), ShouldBeTrue)
+				var opErr *net.OpError
+				So(errors.As(err, &opErr), ShouldBeTrue)
+				So(err.Error(), ShouldContainSubstring, wsServer.addr)
+			})
+		})
+	})
+}
+
+type slowOfflineHandlers struct {
+	lifecycleHandlers
+}
+
+func (h slowOfflineHandlers) OnOffline(id uint) {
+	time.Sleep(time.Millisecond * 200)
+	h.events <- onOffline
+}
+
+func TestOfflineBeforeReconnectOnline(t *testing.T) {
+	Convey("Given WS server with a slow 'OnOffline'", t, func() {
+		h := slowOfflineHandlers{lifecycleHandlers{events: make(chan string, 10)}}
+		srv, err := startTestServer(&Config{
+			Addr:     "localhost:0",
+			Handlers: h,
+		})
+		So(err, ShouldBeNil)
+		c, _, err := dialTestServer(srv, "token=123456", nil)
+		So(err, ShouldBeNil)
+		So(<-h.events, ShouldEqual, onOnline)
+		Convey("When client disconnects and reconnects immediately", func() {
+			c.Close()
+			time.Sleep(time.Millisecond * 50)
+			c2, _, err := dialTestServer(srv, "token=123456", nil)
+			So(err, ShouldBeNil)
+			Convey("Then 'OnOffline' of the old connection should complete before 'OnOnline'", func() {
+				So(receivedEvents(h.events, time.Millisecond*500), ShouldResemble, []string{onOffline, onOnline})
+			})
+			Reset(func() {
+				c2.Close()
+			})
+		})
+	})
+}
+
+func TestRateLimit(t *testing.T) {
+	Convey("Given WS server limiting messages per second", t, func() {
+		h := orderHandlers{texts: make(chan string, 10)}
+		Convey("When client exceeds the limit and excess is dropped", func() {
+			srv, err := startTestServer(&Config{
+				Addr:                 "localhost:0",
+				Handlers:             h,
+				OrderedDelivery:      true,
+				MaxMessagesPerSecond: 2,
+			})
+			So(err, ShouldBeNil)
+			c, _, err := dialTestServer(srv, "token=123456", nil)
+			So(err, ShouldBeNil)
+			for i := 0; i < 5; i++ {
+				c.WriteMessage(websocket.TextMessage, []byte(strconv.Itoa(i)))
+			}
+			Convey("Then only the allowed messages should be delivered", func() {
+				So(receivedEvents(h.texts, time.Millisecond*300), ShouldResemble, []string{"0", "1"})
+			})
+			Reset(func() {
+				c.Close()
+			})
+		})
+		Convey("When client exceeds the limit and excess closes the connection", func() {
+			srv, err := startTestServer(&Config{
+				Addr:                 "localhost:0",
+				Handlers:             h,
+				MaxMessagesPerSecond: 1,
+				RateLimitAction:      RateLimitClose,
+			})
+			So(err, ShouldBeNil)
+			c, _, err := dialTestServer(srv, "token=123456", nil)
+			So(err, ShouldBeNil)
+			c.WriteMessage(websocket.TextMessage, []byte("0"))
+			c.WriteMessage(websocket.TextMessage, []byte("1"))
+			Convey("Then the connection should be closed with 1008", func() {
+				_, _, err := c.ReadMessage()
+				So(websocket.IsCloseError(err, websocket.ClosePolicyViolation), ShouldBeTrue)
+			})
+			Reset(func() {
+				c.Close()
+			})
+		})
+	})
+}
+
+// startTestServer starts WS server with cfg and shuts it down once the
+// Convey block starting it is done.
+func startTestServer(cfg *Config) (*WS, error) {
+	srv, err := Start(cfg)
+	if err == nil {
+		Reset(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			srv.Shutdown(ctx)
+		})
+	}
+	return srv, err
+}
+
+func dialTestServer(srv *WS, query string, h http.Header) (*websocket.Conn, *http.Response, error) {
+	u := url.URL{
+		Scheme:   "ws",
+		Host:     srv.addr,
+		Path:     "/",
+		RawQuery: query,
+	}
+	return websocket.DefaultDialer.Dial(u.String(), h)
+}
+
+func setWSConnection() *websocket.Conn {
+	u := url.URL{
+		Scheme:   "ws",
+		Host:     "localhost:6008",
+		Path:     "/",
+		RawQuery: "token=123456",
+	}
+	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	if err != nil {
+		log.Print(err)
+	}
+	//log.Printf("connection from: %v", c.LocalAddr())
+
+	return c
+}
+
+func TestIsCleanClose(t *testing.T) {
+	Convey("Given read errors", t, func() {
+		Convey("EOF and normal close frames should be clean", func() {
+			So(isCleanClose(io.EOF), ShouldBeTrue)
+			So(isCleanClose(wsutil.ClosedError{Code: ws.StatusNormalClosure}), ShouldBeTrue)
+			So(isCleanClose(wsutil.ClosedError{Code: ws.StatusGoingAway}), ShouldBeTrue)
+			So(isCleanClose(wsutil.ClosedError{Code: ws.StatusNoStatusRcvd}), ShouldBeTrue)
+		})
+		Convey("Protocol errors and abnormal close codes should not be clean", func() {
+			So(isCleanClose(ws.ErrProtocolMaskRequired), ShouldBeFalse)
+			So(isCleanClose(wsutil.ClosedError{Code: ws.StatusProtocolError}), ShouldBeFalse)
+			So(isCleanClose(io.ErrUnexpectedEOF), ShouldBeFalse)
+		})
+	})
+}
+
+func TestAuthCredential(t *testing.T) {
+	Convey("Given WS server accepting the 'Token' scheme", t, func() {
+		w := &WS{authSchemes: []string{"Token"}}
+		Convey("Then the credential of a 'Token' header should be returned", func() {
+			token, ok := w.authCredential("Token abc.def")
+			So(ok, ShouldBeTrue)
+			So(token, ShouldEqual, "abc.def")
+		})
+		Convey("Then other schemes should be rejected", func() {
+			_, ok := w.authCredential("Bearer 123456")
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
+
+func TestReadErrorCloseCode(t *testing.T) {
+	Convey("Given WS server with a connected client", t, func() {
+		srv, err := startTestServer(&Config{
+			Addr:     "localhost:0",
+			Handlers: tokenHandlers{},
+		})
+		So(err, ShouldBeNil)
+		c, _, err := dialTestServer(srv, "token=1", nil)
+		So(err, ShouldBeNil)
+		Convey("When client sends invalid UTF-8 text", func() {
+			So(c.WriteMessage(websocket.TextMessage, []byte{0xff, 0xfe}), ShouldBeNil)
+			Convey("Then the connection should be closed with 1007", func() {
+				_, _, err := c.ReadMessage()
+				So(websocket.IsCloseError(err, websocket.CloseInvalidFramePayloadData), ShouldBeTrue)
+			})
+		})
+		Reset(func() {
+			c.Close()
+		})
+	})
+	Convey("Given read errors", t, func() {
+		Convey("Failed connections should get no close frame", func() {
+			So(DefaultReadErrorCloseCode(io.EOF), ShouldEqual, 0)
+			So(DefaultReadErrorCloseCode(wsutil.ClosedError{Code: ws.StatusNormalClosure}), ShouldEqual, 0)
+		})
+		Convey("Other errors should be closed with 1011", func() {
+			So(DefaultReadErrorCloseCode(errors.New("boom")), ShouldEqual, ws.StatusInternalServerError)
+		})
+	})
+}
+
+func TestIsDeadConnError(t *testing.T) {
+	Convey("Given write errors", t, func() {
+		Convey("Broken pipe and reset should mean a dead connection", func() {
+			So(isDeadConnError(&net.OpError{Op: "write", Err: os.NewSyscallError("write", syscall.EPIPE)}), ShouldBeTrue)
+			So(isDeadConnError(&net.OpError{Op: "write", Err: os.NewSyscallError("write", syscall.ECONNRESET)}), ShouldBeTrue)
+		})
+		Convey("Other errors should not", func() {
+			So(isDeadConnError(nil), ShouldBeFalse)
+			So(isDeadConnError(io.ErrShortWrite), ShouldBeFalse)
+		})
+	})
+}
+
+func TestAddrString(t *testing.T) {
+	Convey("Given network addresses", t, func() {
+		Convey("IPv4 and IPv6 addresses should be formatted as host:port", func() {
+			So(addrString(&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 6006}), ShouldEqual, "127.0.0.1:6006")
+			So(addrString(&net.TCPAddr{IP: net.ParseIP("::1"), Port: 6006}), ShouldEqual, "[::1]:6006")
+		})
+		Convey("IPv6 hosts should be split without brackets", func() {
+			host, port, err := splitAddr(&net.TCPAddr{IP: net.ParseIP("::1"), Port: 6006})
+			So(err, ShouldBeNil)
+			So(host, ShouldEqual, "::1")
+			So(port, ShouldEqual, "6006")
+		})
+		Convey("Other networks should keep their name", func() {
+			So(addrString(&net.UnixAddr{Name: "/tmp/ws.sock", Net: "unix"}), ShouldEqual, "unix:/tmp/ws.sock")
+		})
+		Convey("Missing addresses should not panic", func() {
+			var a *net.TCPAddr
+			So(addrString(nil), ShouldEqual, "-")
+			So(addrString(a), ShouldEqual, "-")
+		})
+	})
+}
+
+func TestQueryParam(t *testing.T) {
+	Convey("Given a query with a base64 token", t, func() {
+		Convey("Then '+', '/' and '=' should survive", func() {
+			token, ok := queryParam("a=1&token=ab+c/d==", AuthTokenKey)
+			So(ok, ShouldBeTrue)
+			So(token, ShouldEqual, "ab+c/d==")
+		})
+		Convey("Then percent-encoded values should be decoded", func() {
+			token, ok := queryParam("token=ab%2Bc%2Fd%3D%3D", AuthTokenKey)
+			So(ok, ShouldBeTrue)
+			So(token, ShouldEqual, "ab+c/d==")
+		})
+		Convey("Then a missing key should not be found", func() {
+			_, ok := queryParam("a=1", AuthTokenKey)
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
+
+// BenchmarkConnLookup looks up connections while others register and
+// unregister, locking only their shard like handle does, with one shard
+// and with the default.
+func BenchmarkConnLookup(b *testing.B) {
+	for _, shards := range []int{1, DefaultConnShards} {
+		b.Run(strconv.Itoa(shards)+"Shards", func(b *testing.B) {
+			w, err := New(&Config{
+				Handlers:   THandlers{},
+				Logger:     log.New(ioutil.Discard, "", 0),
+				ConnShards: shards,
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+			const conns = 1024
+			for id := uint(1); id <= conns; id++ {
+				w.shard(id).conns[id] = &client{}
+			}
+
+			var seq uint64
+			b.RunParallel(func(pb *testing.PB) {
+				id := uint(atomic.AddUint64(&seq, 1))
+				for i := 0; pb.Next(); i++ {
+					id = id*7 + 1
+					if i%16 == 0 {
+						churn := conns + 1 + id%conns
+						s, unlock := w.lockID(churn)
+						s.conns[churn] = &client{}
+						delete(s.conns, churn)
+						unlock()
+						continue
+					}
+					w.conn(1 + id%conns)
+				}
+			})
+		})
+	}
+}
+
+func TestRawConn(t *testing.T) {
+	Convey("Given WS server with a client connected through a pipe", t, func() {
+		srv, err := New(&Config{Handlers: tokenHandlers{}})
+		So(err, ShouldBeNil)
+		server, client := net.Pipe()
+		go srv.HandleConn(server)
+		d := websocket.Dialer{
+			NetDial: func(network, addr string) (net.Conn, error) {
+				return client, nil
+			},
+		}
+		c, _, err := d.Dial("ws://pipe/?token=1", nil)
+		So(err, ShouldBeNil)
+		time.Sleep(time.Millisecond * 100)
+		Convey("RawConn should return the underlying conn of a connected id", func() {
+			conn, ok := srv.RawConn(1)
+			So(ok, ShouldBeTrue)
+			So(conn, ShouldEqual, server)
+		})
+		Convey("RawConn of an unknown id should fail", func() {
+			conn, ok := srv.RawConn(2)
+			So(ok, ShouldBeFalse)
+			So(conn, ShouldBeNil)
+		})
+		Reset(func() {
+			c.Close()
+		})
+	})
+}
+
+// sockBuffer returns the socket option opt of conn, e.g. syscall.SO_RCVBUF.
+func sockBuffer(conn *net.TCPConn, opt int) (n int) {
+	rc, err := conn.SyscallConn()
+	So(err, ShouldBeNil)
+	So(rc.Control(func(fd uintptr) {
+		n, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, opt)
+	}), ShouldBeNil)
+	So(err, ShouldBeNil)
+	return n
+}
+
+func TestSetBuffers(t *testing.T) {
+	Convey("Given WS server with TCP buffer sizes", t, func() {
+		srv, err := New(&Config{
+			Handlers:       tokenHandlers{},
+			TCPReadBuffer:  256 << 10,
+			TCPWriteBuffer: 128 << 10,
+		})
+		So(err, ShouldBeNil)
+		Convey("When they are applied to a TCP conn", func() {
+			ln, err := net.Listen("tcp", "localhost:0")
+			So(err, ShouldBeNil)
+			defer ln.Close()
+			client, err := net.Dial("tcp", ln.Addr().String())
+			So(err, ShouldBeNil)
+			defer client.Close()
+			conn, err := ln.Accept()
+			So(err, ShouldBeNil)
+			defer conn.Close()
+			srv.setBuffers(conn)
+			Convey("Then its socket buffers should be at least that large", func() {
+				So(sockBuffer(conn.(*net.TCPConn), syscall.SO_RCVBUF), ShouldBeGreaterThanOrEqualTo, 256<<10)
+				So(sockBuffer(conn.(*net.TCPConn), syscall.SO_SNDBUF), ShouldBeGreaterThanOrEqualTo, 128<<10)
+			})
+		})
+		Convey("Other conns should be left alone", func() {
+			server, client := net.Pipe()
+			defer client.Close()
+			So(func() { srv.setBuffers(server) }, ShouldNotPanic)
+			So(server.Close(), ShouldBeNil)
+		})
+	})
 }